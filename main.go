@@ -1,15 +1,32 @@
 package main
 
 import (
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
 	"os"
+	"os/signal"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 	"github.com/mmcdole/gofeed"
@@ -17,293 +34,2613 @@ import (
 )
 
 type Article struct {
-	Title   string
-	Link    string
-	Summary string
-	Date    time.Time
+	Title    string
+	Link     string
+	GUID     string
+	Feed     string // Name of the FeedSource the article came from
+	Summary  string
+	Content  string   // Raw description, for re-trimming the summary per chat
+	Severity Severity // Keyword-based estimate, see classifySeverity
+	Date     time.Time
+
+	ContentHash string // Hash of the title and description, see contentHash
+	Updated     bool   // Already sent before, but the content has changed since
+}
+
+// Severity is a rough estimate of how urgent a security article is
+type Severity int
+
+const (
+	SeverityLow Severity = iota
+	SeverityMedium
+	SeverityHigh
+	SeverityCritical
+)
+
+var severityNames = []string{"low", "medium", "high", "critical"}
+
+func (s Severity) String() string {
+	return severityNames[s]
+}
+
+// parseSeverity resolves a severity name as used by /alert
+func parseSeverity(name string) (Severity, bool) {
+	for i, n := range severityNames {
+		if n == name {
+			return Severity(i), true
+		}
+	}
+	return SeverityLow, false
+}
+
+// severityRules are checked from the most severe down; the first match wins.
+// \b only works for ASCII, so Cyrillic stems are matched as substrings
+var severityRules = []struct {
+	severity Severity
+	pattern  *regexp.Regexp
+}{
+	{SeverityCritical, regexp.MustCompile(`\b(0-day|zero-day|rce|actively exploited|cvss:? ?(9|10)(\.\d)?)\b|нулевого дня|удал[её]нное выполнение кода|активно эксплуатиру`)},
+	{SeverityHigh, regexp.MustCompile(`\b(cve-\d+-\d+|exploit|ransomware|data breach)\b|уязвимост|эксплойт|утечк|взлом|вымогател`)},
+	{SeverityMedium, regexp.MustCompile(`\b(malware|phishing|backdoor|botnet|ddos)\b|атак|вредонос|фишинг|бэкдор|ботнет`)},
+}
+
+// classifySeverity estimates an article's severity from keywords in its
+// title and description
+func classifySeverity(title, description string) Severity {
+	text := strings.ToLower(title + "\n" + description)
+	for _, rule := range severityRules {
+		if rule.pattern.MatchString(text) {
+			return rule.severity
+		}
+	}
+	return SeverityLow
+}
+
+// contentHash fingerprints what a reader sees of an item, so edits to an
+// already sent article can be detected
+func contentHash(title, description string) string {
+	sum := sha1.Sum([]byte(title + "\n" + description))
+	return hex.EncodeToString(sum[:])
+}
+
+// ID returns a stable short identifier for the article derived from its
+// GUID, falling back to the link for feeds that don't provide one
+func (a Article) ID() string {
+	source := a.GUID
+	if source == "" {
+		source = a.Link
+	}
+	sum := sha1.Sum([]byte(source))
+	return hex.EncodeToString(sum[:8])
+}
+
+// FeedSource is an RSS feed merged into the main article stream
+type FeedSource struct {
+	Name string
+	URL  string
+	// Weight sets the feed's priority in the merged stream: its share of the
+	// article slots, and its rank among articles published at the same time
+	Weight int
+	// FallbackURL is an optional mirror used when URL can't be fetched
+	FallbackURL string
+}
+
+// habrHubFeedURL is the RSS feed of a single Habr hub
+const habrHubFeedURL = "https://habr.com/ru/rss/hub/%s/all/?fl=ru"
+
+// defaultHub is the hub served by /infosec and the API
+const defaultHub = "infosecurity"
+
+// habrHubs is the allowlist of hubs that can be requested for a one-off
+// peek with "/infosec@<hub>" or "/infosec topic:<hub>"
+var habrHubs = map[string]string{
+	"infosecurity":         "Информационная безопасность",
+	"cryptography":         "Криптография",
+	"reverse-engineering":  "Реверс-инжиниринг",
+	"network_technologies": "Сетевые технологии",
+	"linux":                "Linux",
+	"devops":               "DevOps",
+	"go":                   "Go",
+	"python":               "Python",
+	"programming":          "Программирование",
+}
+
+// Sender delivers messages to Telegram. It is satisfied by *tgbotapi.BotAPI
+type Sender interface {
+	Send(c tgbotapi.Chattable) (tgbotapi.Message, error)
+}
+
+// Clock tells the current time. The bot reads time through it so tests can
+// substitute a fake clock and advance it to exercise expiry logic
+type Clock interface {
+	Now() time.Time
 }
 
+// realClock is the default Clock backed by time.Now
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
 type Bot struct {
 	bot         *tgbotapi.BotAPI
+	clock       Clock
+	sender      Sender           // used for all outgoing messages, normally bot itself
+	sendLatency *latencyHistogram // duration of sender calls by message type
+	startedAt   time.Time         // when the bot was created, for uptime
+	lastFetchLatency atomic.Int64 // duration of the last successful feed download, ns
 	fp          *gofeed.Parser
 	limiter     *rate.Limiter
-	articles    map[string]bool // to track sent articles
-	articlesMux sync.RWMutex    // mutex to protect articles map
+	seen        SeenStore       // to track articles sent by /infosec
+	pushed      SeenStore       // to track articles pushed by the poller, kept apart so /infosec and the API can't take them from push chats
+	articlesMux sync.RWMutex    // mutex to make check-then-update on seen atomic
 	httpClient  *http.Client    // HTTP client with timeout
+	feedDialer  *feedDialer     // refuses connections into the internal network
 	articleExpiry time.Duration // How long to keep articles in memory (e.g., 24 hours)
-	articleTimestamps map[string]time.Time // Track when articles were added
+	notifyUpdates bool // Resend articles whose content changed after they were sent
+	renotifyInterval time.Duration // Minimum time between notifications for the same article
+	summaryCutMarkers []string // "Read more" markers trimSummary cuts at
+	summaryLength int // Default summary length in characters
+	summaryBlockquote bool // Render summaries as Telegram blockquotes
+	blockquoteUnsupported atomic.Bool // Telegram rejected <blockquote>, send plain summaries
+	settings *settingsStore // Per-chat preferences
+	history *historyStore // Articles seen in the feeds, for roundups
+	historyRetention time.Duration // How long articles stay in the history
+	historyArchiveAfter time.Duration // Age at which history entries lose their text, 0 disables
+	futureDateTolerance time.Duration // How far ahead of now a publication date may be
+	skipFutureDates bool // Drop articles dated beyond the tolerance instead of clamping them
+
+	feeds    []FeedSource // Feeds merged into /infosec and the API
+	feedsMux sync.RWMutex // mutex to protect feeds and removedFeeds
+	removedFeeds []string // names of feeds dropped with /removefeed
+	removedFeedsPath string // where removedFeeds is persisted, empty when it isn't
+
+	chatHourlyCap  int                   // Max articles pushed to one chat per rolling hour, 0 disables
+	deferOverflow  bool                  // Queue articles over the cap instead of dropping them
+	chatSends      map[int64][]time.Time // Send times per chat within the last hour
+	deferredArticles map[int64][]Article // Articles held back by the hourly cap
+	overflowNotices map[int64]time.Time  // When each chat was last told about the cap
+	chatSendsMux   sync.Mutex            // mutex to protect chatSends, deferredArticles and overflowNotices
+	sendInterval   time.Duration         // Pause between article messages to stay under Telegram's limits
+
+	feedCache    map[string]*feedCacheEntry // Parsed hub feeds by hub name
+	feedCacheMux sync.Mutex                 // mutex to protect feedCache
+	feedCacheTTL time.Duration              // How long a cached feed is served without refreshing
+	feedMaxStale time.Duration              // How old a cached feed may get before a fetch blocks
+
+	pushChatIDs  []int64       // Chats that receive new articles from the poller
+	pushChatsMux sync.RWMutex  // mutex to protect pushChatIDs, which change on chat migration
+	pollInterval time.Duration // How often the poller runs, 0 disables it
+	adminAPIKey  string        // Bearer token for /api/admin endpoints, empty disables them
+
+	adminIDs    map[int64]bool // Telegram user IDs allowed to run admin commands
+	maintenance atomic.Bool    // When set, user commands and the API are paused
 }
 
-func NewBot(token string) *Bot {
-	bot, err := tgbotapi.NewBotAPI(token)
+// feedCacheEntry is a hub feed as last fetched
+type feedCacheEntry struct {
+	articles   []Article
+	fetchedAt  time.Time
+	refreshing bool // a background refresh is in flight
+}
+
+// loadJSONFile decodes the JSON file at path into v. A missing file is not
+// an error and leaves v untouched
+func loadJSONFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
 	if err != nil {
-		log.Panic(err)
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
 	}
+	return nil
+}
 
-	return &Bot{
-		bot:      bot,
-		fp:       gofeed.NewParser(),
-		limiter:  rate.NewLimiter(rate.Every(1*time.Second), 1),
-		articles: make(map[string]bool),
-		articleTimestamps: make(map[string]time.Time),
-		articleExpiry: 24 * time.Hour, // Keep articles for 24 hours
-		httpClient: &http.Client{
-			Timeout: 30 * time.Second,
-		},
+// writeFileAtomic writes data to a temporary file and renames it over path,
+// so a crash mid-write never leaves a truncated file behind
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
 	}
+	return os.Rename(tmp, path)
 }
 
-// NewBotWithoutTelegram creates a bot instance without connecting to Telegram API
-// This is used for web-only mode where only the API and web interface are needed
-func NewBotWithoutTelegram() *Bot {
-	return &Bot{
-		bot:      nil, // No Telegram bot connection
-		fp:       gofeed.NewParser(),
-		limiter:  rate.NewLimiter(rate.Every(1*time.Second), 1),
-		articles: make(map[string]bool),
-		articleTimestamps: make(map[string]time.Time),
-		articleExpiry: 24 * time.Hour, // Keep articles for 24 hours
-		httpClient: &http.Client{
-			Timeout: 30 * time.Second,
-		},
+// SeenEntry is what the bot remembers about a sent article
+type SeenEntry struct {
+	SentAt      time.Time `json:"sent_at"`
+	Feed        string    `json:"feed,omitempty"`
+	ContentHash string    `json:"content_hash,omitempty"`
+	// RenotifiedAt is when an update of the article was last sent
+	RenotifiedAt time.Time `json:"renotified_at,omitempty"`
+}
+
+// SeenStore keeps the dedup state keyed by Article.ID. Implementations
+// must be safe for concurrent use
+type SeenStore interface {
+	Get(key string) (SeenEntry, bool)
+	Put(key string, entry SeenEntry)
+	// MarkIfNew stores entry unless key holds an entry younger than expiry
+	// (measured at entry.SentAt), reporting whether it stored it. The check
+	// and the write are atomic, so concurrent callers can't both win
+	MarkIfNew(key string, entry SeenEntry, expiry time.Duration) bool
+	Delete(keys ...string)
+	Range(fn func(key string, entry SeenEntry))
+	Len() int
+}
+
+// memorySeenStore is the default SeenStore; its contents are lost on restart
+type memorySeenStore struct {
+	mu      sync.RWMutex
+	entries map[string]SeenEntry
+}
+
+func newMemorySeenStore() *memorySeenStore {
+	return &memorySeenStore{entries: make(map[string]SeenEntry)}
+}
+
+func (s *memorySeenStore) Get(key string) (SeenEntry, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, ok := s.entries[key]
+	return entry, ok
+}
+
+func (s *memorySeenStore) Put(key string, entry SeenEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[key] = entry
+}
+
+func (s *memorySeenStore) MarkIfNew(key string, entry SeenEntry, expiry time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.entries[key]; ok && entry.SentAt.Sub(existing.SentAt) <= expiry {
+		return false
 	}
+	s.entries[key] = entry
+	return true
 }
 
-func (b *Bot) Start() {
-	if b.bot == nil {
-		// In web-only mode, don't start the Telegram bot
-		log.Println("Running in web-only mode - Telegram bot disabled")
-		// Keep the cleanup goroutine running
-		go func() {
-			ticker := time.NewTicker(1 * time.Hour) // Clean up every hour
-			defer ticker.Stop()
-			for range ticker.C {
-				b.cleanupExpiredArticles()
-				log.Println("Cleaned up expired articles")
-			}
-		}()
-		
-		// Wait indefinitely since there's no bot to run
-		select {}
+func (s *memorySeenStore) Delete(keys ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range keys {
+		delete(s.entries, key)
 	}
-	
-	log.Printf("Authorized on account %s", b.bot.Self.UserName)
+}
 
-	// Start periodic cleanup of expired articles
-	go func() {
-		ticker := time.NewTicker(1 * time.Hour) // Clean up every hour
-		defer ticker.Stop()
-		for range ticker.C {
-			b.cleanupExpiredArticles()
-			log.Println("Cleaned up expired articles")
-		}
-	}()
+func (s *memorySeenStore) Range(fn func(key string, entry SeenEntry)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
+	for key, entry := range s.entries {
+		fn(key, entry)
+	}
+}
 
-	updates, err := b.bot.GetUpdatesChan(u)
-	if err != nil {
-		log.Panic(err)
+func (s *memorySeenStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.entries)
+}
+
+// fileSeenStore is a memorySeenStore persisted as a JSON file, so dedup and
+// update detection survive restarts. The file is rewritten on every change
+type fileSeenStore struct {
+	*memorySeenStore
+	path   string
+	saveMu sync.Mutex
+}
+
+func newFileSeenStore(path string) (*fileSeenStore, error) {
+	s := &fileSeenStore{memorySeenStore: newMemorySeenStore(), path: path}
+	if err := loadJSONFile(path, &s.entries); err != nil {
+		return nil, err
 	}
+	return s, nil
+}
 
-	for update := range updates {
-		if update.Message != nil {
-			go b.handleMessage(update.Message)
-		}
+func (s *fileSeenStore) Put(key string, entry SeenEntry) {
+	s.memorySeenStore.Put(key, entry)
+	s.save()
+}
+
+func (s *fileSeenStore) MarkIfNew(key string, entry SeenEntry, expiry time.Duration) bool {
+	if !s.memorySeenStore.MarkIfNew(key, entry, expiry) {
+		return false
 	}
+	s.save()
+	return true
 }
 
-func (b *Bot) handleMessage(msg *tgbotapi.Message) {
-	if !b.limiter.Allow() {
+func (s *fileSeenStore) Delete(keys ...string) {
+	if len(keys) == 0 {
 		return
 	}
+	s.memorySeenStore.Delete(keys...)
+	s.save()
+}
 
-	chatID := msg.Chat.ID
-	text := strings.TrimSpace(msg.Text)
+// save writes all entries back to the file
+func (s *fileSeenStore) save() {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
 
-	switch text {
-	case "/start":
-		b.sendWelcomeMessage(chatID)
-	case "/help":
-		b.sendHelpMessage(chatID)
-	case "/infosec", "/security":
-		b.sendInfoSecFeed(chatID)
-	default:
-		b.sendWelcomeMessage(chatID)
+	s.mu.RLock()
+	data, err := json.Marshal(s.entries)
+	s.mu.RUnlock()
+	if err != nil {
+		log.Printf("Error encoding seen store: %v", err)
+		return
+	}
+	if err := writeFileAtomic(s.path, data); err != nil {
+		log.Printf("Error writing seen store: %v", err)
 	}
 }
 
-// Safe method to check if an article was already sent
-func (b *Bot) wasArticleSent(guid string) bool {
-	b.articlesMux.Lock() // Need write lock because we might cleanup
-	defer b.articlesMux.Unlock()
-	
-	// Check if article exists
-	if exists, ok := b.articles[guid]; ok && exists {
-		// Check if the article has expired
-		if time.Since(b.articleTimestamps[guid]) > b.articleExpiry {
-			// Remove expired article
-			delete(b.articles, guid)
-			delete(b.articleTimestamps, guid)
-			return false
+// ChatSettings holds one chat's preferences. Zero values mean "use the
+// bot-wide default"
+type ChatSettings struct {
+	SummaryLength int    `json:"summary_length,omitempty"`
+	AlertSeverity string `json:"alert_severity,omitempty"` // /alert threshold, empty when off
+	// Weekly is the /weekly roundup schedule, nil when off. It is shared
+	// between copies, so replace it instead of modifying it in place
+	Weekly *WeeklyRoundup `json:"weekly,omitempty"`
+}
+
+// WeeklyRoundup schedules a weekly message with a chat's top articles
+type WeeklyRoundup struct {
+	Count    int          `json:"count"`
+	Day      time.Weekday `json:"day"`
+	Hour     int          `json:"hour"`
+	Minute   int          `json:"minute"`
+	LastSent time.Time    `json:"last_sent"`
+}
+
+// lastOccurrence returns the most recent scheduled time at or before now
+func (w WeeklyRoundup) lastOccurrence(now time.Time) time.Time {
+	at := time.Date(now.Year(), now.Month(), now.Day(), w.Hour, w.Minute, 0, 0, now.Location())
+	at = at.AddDate(0, 0, -((int(now.Weekday()) - int(w.Day) + 7) % 7))
+	if at.After(now) {
+		at = at.AddDate(0, 0, -7)
+	}
+	return at
+}
+
+// due reports whether a roundup should go out: a scheduled time has passed
+// since the last one was sent
+func (w WeeklyRoundup) due(now time.Time) bool {
+	return w.LastSent.Before(w.lastOccurrence(now))
+}
+
+// HistoryEntry is an article kept in the history
+type HistoryEntry struct {
+	Article
+	SeenAt   time.Time `json:"seen_at"`            // when the article first showed up in a feed
+	Archived bool      `json:"archived,omitempty"` // summary and content dropped to save space
+}
+
+// historyStore keeps the articles seen in the configured feeds so roundups
+// can look back over the week. When a path is set it is persisted as a
+// JSON file rewritten whenever new articles arrive
+type historyStore struct {
+	mu      sync.RWMutex
+	entries map[string]HistoryEntry // by Article.ID
+	path    string
+	saveMu  sync.Mutex
+}
+
+func newHistoryStore() *historyStore {
+	return &historyStore{entries: make(map[string]HistoryEntry)}
+}
+
+// openHistoryStore loads the history from path, starting empty if the file
+// doesn't exist yet
+func openHistoryStore(path string) (*historyStore, error) {
+	h := newHistoryStore()
+	h.path = path
+	if err := loadJSONFile(path, &h.entries); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Add records articles first seen at now. Known articles keep their first
+// seen time but pick up content changes
+func (h *historyStore) Add(articles []Article, now time.Time) {
+	changed := false
+	h.mu.Lock()
+	for _, article := range articles {
+		article.Updated = false
+		id := article.ID()
+		entry, ok := h.entries[id]
+		if ok && entry.ContentHash == article.ContentHash {
+			continue
 		}
-		return true
+		if !ok {
+			entry.SeenAt = now
+		}
+		entry.Article = article
+		entry.Archived = false
+		h.entries[id] = entry
+		changed = true
+	}
+	h.mu.Unlock()
+
+	if changed {
+		h.save()
 	}
-	return false
 }
 
-// Safe method to mark an article as sent
-func (b *Bot) markArticleAsSent(guid string) {
-	b.articlesMux.Lock()
-	defer b.articlesMux.Unlock()
-	
-	b.articles[guid] = true
-	b.articleTimestamps[guid] = time.Now()
+// Since returns the articles published after cutoff, in no particular order
+func (h *historyStore) Since(cutoff time.Time) []Article {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var articles []Article
+	for _, entry := range h.entries {
+		if entry.Date.After(cutoff) {
+			articles = append(articles, entry.Article)
+		}
+	}
+	return articles
 }
 
-// Clean up expired articles periodically
-func (b *Bot) cleanupExpiredArticles() {
-	b.articlesMux.Lock()
-	defer b.articlesMux.Unlock()
-	
-	now := time.Now()
-	for guid, timestamp := range b.articleTimestamps {
-		if now.Sub(timestamp) > b.articleExpiry {
-			delete(b.articles, guid)
-			delete(b.articleTimestamps, guid)
+// Prune drops articles first seen before cutoff
+func (h *historyStore) Prune(cutoff time.Time) {
+	removed := 0
+	h.mu.Lock()
+	for id, entry := range h.entries {
+		if entry.SeenAt.Before(cutoff) {
+			delete(h.entries, id)
+			removed++
 		}
 	}
+	h.mu.Unlock()
+
+	if removed > 0 {
+		h.save()
+	}
 }
 
-func (b *Bot) sendWelcomeMessage(chatID int64) {
-	msg := tgbotapi.NewMessage(chatID, "Привет! Я бот, который предоставляет RSS-ленту статей с Хабра по теме информационной безопасности.\n\nДоступные команды:\n/infosec или /security - получить последние статьи по информационной безопасности")
-	_, err := b.bot.Send(msg)
+// RemoveFeed drops the articles of a removed feed. Articles that owners
+// says another feed carries too are kept and attributed to that feed. It
+// returns how many were dropped
+func (h *historyStore) RemoveFeed(feed string, owners map[string]string) int {
+	removed, changed := 0, false
+	h.mu.Lock()
+	for id, entry := range h.entries {
+		if entry.Feed != feed {
+			continue
+		}
+		changed = true
+		if owner, ok := owners[id]; ok {
+			entry.Feed = owner
+			h.entries[id] = entry
+		} else {
+			delete(h.entries, id)
+			removed++
+		}
+	}
+	h.mu.Unlock()
+
+	if changed {
+		h.save()
+	}
+	return removed
+}
+
+// Archive drops the summary and content of articles first seen before
+// cutoff, keeping title, link and dates. It returns how many were archived
+func (h *historyStore) Archive(cutoff time.Time) int {
+	archived := 0
+	h.mu.Lock()
+	for id, entry := range h.entries {
+		if entry.Archived || !entry.SeenAt.Before(cutoff) {
+			continue
+		}
+		entry.Summary, entry.Content = "", ""
+		entry.Archived = true
+		h.entries[id] = entry
+		archived++
+	}
+	h.mu.Unlock()
+
+	if archived > 0 {
+		h.save()
+	}
+	return archived
+}
+
+// Entries returns the whole history, newest first
+func (h *historyStore) Entries() []HistoryEntry {
+	h.mu.RLock()
+	entries := make([]HistoryEntry, 0, len(h.entries))
+	for _, entry := range h.entries {
+		entries = append(entries, entry)
+	}
+	h.mu.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Date.After(entries[j].Date)
+	})
+	return entries
+}
+
+// Len returns the number of articles in the history
+func (h *historyStore) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return len(h.entries)
+}
+
+// save writes the history back to the file
+func (h *historyStore) save() {
+	if h.path == "" {
+		return
+	}
+	h.saveMu.Lock()
+	defer h.saveMu.Unlock()
+
+	h.mu.RLock()
+	data, err := json.Marshal(h.entries)
+	h.mu.RUnlock()
 	if err != nil {
-		log.Printf("Error sending welcome message: %v", err)
+		log.Printf("Error encoding article history: %v", err)
+		return
+	}
+	if err := writeFileAtomic(h.path, data); err != nil {
+		log.Printf("Error writing article history: %v", err)
 	}
 }
 
-func (b *Bot) sendHelpMessage(chatID int64) {
-	helpText := "Доступные команды:\n" +
-		"/infosec или /security - получить последние статьи по информационной безопасности\n" +
-		"/help - показать это сообщение\n" +
-		"/start - начать работу с ботом"
+// settingsStore keeps per-chat settings in memory and, when a path is set,
+// persists them as a JSON file rewritten on every change
+type settingsStore struct {
+	mu     sync.RWMutex
+	chats  map[int64]ChatSettings
+	path   string
+	saveMu sync.Mutex
+}
 
-	msg := tgbotapi.NewMessage(chatID, helpText)
-	_, err := b.bot.Send(msg)
+func newSettingsStore() *settingsStore {
+	return &settingsStore{chats: make(map[int64]ChatSettings)}
+}
+
+// openSettingsStore loads settings from path, starting empty if the file
+// doesn't exist yet
+func openSettingsStore(path string) (*settingsStore, error) {
+	s := newSettingsStore()
+	s.path = path
+	if err := loadJSONFile(path, &s.chats); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get returns the chat's settings, zero valued if it has none
+func (s *settingsStore) Get(chatID int64) ChatSettings {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.chats[chatID]
+}
+
+// Update applies fn to the chat's settings and persists the result
+func (s *settingsStore) Update(chatID int64, fn func(*ChatSettings)) {
+	s.mu.Lock()
+	cs := s.chats[chatID]
+	fn(&cs)
+	s.chats[chatID] = cs
+	s.mu.Unlock()
+
+	s.save()
+}
+
+// Range calls fn for every chat with stored settings
+func (s *settingsStore) Range(fn func(chatID int64, cs ChatSettings)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for chatID, cs := range s.chats {
+		fn(chatID, cs)
+	}
+}
+
+// Move re-keys a chat's settings, e.g. when a group becomes a supergroup.
+// Settings already stored under newID are kept
+func (s *settingsStore) Move(oldID, newID int64) {
+	s.mu.Lock()
+	cs, ok := s.chats[oldID]
+	if ok {
+		delete(s.chats, oldID)
+		if _, exists := s.chats[newID]; !exists {
+			s.chats[newID] = cs
+		}
+	}
+	s.mu.Unlock()
+
+	if ok {
+		s.save()
+	}
+}
+
+// Len returns the number of chats with stored settings
+func (s *settingsStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.chats)
+}
+
+// save writes all settings back to the file
+func (s *settingsStore) save() {
+	if s.path == "" {
+		return
+	}
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	s.mu.RLock()
+	data, err := json.Marshal(s.chats)
+	s.mu.RUnlock()
 	if err != nil {
-		log.Printf("Error sending help message: %v", err)
+		log.Printf("Error encoding chat settings: %v", err)
+		return
+	}
+	if err := writeFileAtomic(s.path, data); err != nil {
+		log.Printf("Error writing chat settings: %v", err)
 	}
 }
 
-func (b *Bot) sendInfoSecFeed(chatID int64) {
-	msg := tgbotapi.NewMessage(chatID, "Получаю последние статьи по информационной безопасности с Хабра...")
-	sentMsg, err := b.bot.Send(msg)
+// maxDeferredArticles bounds the per-chat overflow queue
+const maxDeferredArticles = 50
+
+func NewBot(token string) *Bot {
+	bot, err := tgbotapi.NewBotAPI(token)
 	if err != nil {
-		log.Printf("Error sending loading message: %v", err)
-		// If we can't send the loading message, try to proceed anyway
-		// Create a dummy message ID to avoid issues later
-		sentMsg = tgbotapi.Message{MessageID: 0}
+		log.Panic(err)
+	}
+
+	b := NewBotWithoutTelegram()
+	b.bot = bot
+	b.sender = bot
+	return b
+}
+
+// NewBotWithoutTelegram creates a bot instance without connecting to Telegram API
+// This is used for web-only mode where only the API and web interface are needed
+func NewBotWithoutTelegram() *Bot {
+	httpClient := &http.Client{
+		Timeout:       30 * time.Second,
+		CheckRedirect: checkFeedRedirect,
+	}
+	fp := gofeed.NewParser()
+	// Fetch feeds through our client so the timeout and redirect policy apply
+	fp.Client = httpClient
+
+	b := &Bot{
+		bot:      nil, // No Telegram bot connection
+		clock:    realClock{},
+		startedAt: time.Now(),
+		fp:       fp,
+		limiter:  rate.NewLimiter(rate.Every(1*time.Second), 1),
+		seen:     newMemorySeenStore(),
+		pushed:   newMemorySeenStore(),
+		feeds: []FeedSource{{Name: defaultHub, URL: fmt.Sprintf(habrHubFeedURL, defaultHub), Weight: 1}},
+		articleExpiry: 24 * time.Hour, // Keep articles for 24 hours
+		renotifyInterval: 6 * time.Hour,
+		summaryCutMarkers: []string{"<!-- more -->", "<!--more-->", "#habracut", `name="habracut"`},
+		summaryLength: 200,
+		settings: newSettingsStore(),
+		history: newHistoryStore(),
+		historyRetention: 8 * 24 * time.Hour, // A week plus a day of slack for roundups
+		futureDateTolerance: 10 * time.Minute,
+		httpClient: httpClient,
+		sendLatency: newLatencyHistogram(),
+		chatHourlyCap: 60,
+		deferOverflow: true,
+		chatSends: make(map[int64][]time.Time),
+		deferredArticles: make(map[int64][]Article),
+		overflowNotices: make(map[int64]time.Time),
+		sendInterval: 500 * time.Millisecond,
+		feedCache: make(map[string]*feedCacheEntry),
+		feedCacheTTL: 5 * time.Minute,
+		feedMaxStale: time.Hour,
+		adminIDs: make(map[int64]bool),
+	}
+
+	// Vet the address every feed connection goes to, redirects included
+	b.feedDialer = &feedDialer{lookup: net.DefaultResolver.LookupIPAddr, trusted: b.isTrustedFeedHost}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = b.feedDialer.DialContext
+	httpClient.Transport = transport
+	return b
+}
+
+// maxFeedRedirects caps how many redirects a feed fetch follows
+const maxFeedRedirects = 5
+
+// checkFeedRedirect is the redirect policy for feed fetches. Redirects,
+// including the common http to https upgrade, are followed up to
+// maxFeedRedirects. Redirects to non-HTTP schemes or to local and private
+// addresses are refused so a feed can't bounce us into the internal
+// network. An https to http downgrade is followed but logged as suspicious
+func checkFeedRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxFeedRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxFeedRedirects)
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return fmt.Errorf("redirect to unsupported scheme %q refused", req.URL.Scheme)
+	}
+	if isPrivateHost(req.URL.Hostname()) {
+		return fmt.Errorf("redirect to private address %s refused", req.URL.Hostname())
+	}
+
+	prev := via[len(via)-1].URL
+	if prev.Scheme == "https" && req.URL.Scheme == "http" {
+		log.Printf("Warning: suspicious redirect downgrading %s to %s", prev, req.URL)
+	}
+	return nil
+}
+
+// isPrivateHost reports whether host is localhost or an IP literal in a
+// loopback, private, link-local or unspecified range. Host names are not
+// resolved here; feedDialer checks the addresses they resolve to
+func isPrivateHost(host string) bool {
+	if strings.EqualFold(host, "localhost") || strings.HasSuffix(strings.ToLower(host), ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && isPrivateIP(ip)
+}
+
+// isPrivateIP reports whether ip is in a loopback, private, link-local or
+// unspecified range
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+// feedDialer opens feed connections. Hosts that aren't trusted are resolved
+// first and refused if any address is private, so neither a redirect nor a
+// public name pointing into the internal network can reach it. The checked
+// address is dialed directly, so a second lookup can't swap it out
+type feedDialer struct {
+	dialer  net.Dialer
+	lookup  func(ctx context.Context, host string) ([]net.IPAddr, error)
+	trusted func(host string) bool
+}
+
+func (d *feedDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if d.trusted(host) {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+
+	ips, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", host)
+	}
+	for _, ip := range ips {
+		if isPrivateIP(ip.IP) {
+			return nil, fmt.Errorf("connection to %s refused: %s is a private address", host, ip.IP)
+		}
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		if conn, err = d.dialer.DialContext(ctx, network, net.JoinHostPort(ip.IP.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// isTrustedFeedHost reports whether host was configured by the operator,
+// as a feed, a fallback mirror or an HTTP proxy. Those may live in the
+// internal network; only hosts reached some other way are vetted
+func (b *Bot) isTrustedFeedHost(host string) bool {
+	for _, feed := range b.listFeeds() {
+		for _, raw := range []string{feed.URL, feed.FallbackURL} {
+			if u, err := url.Parse(raw); err == nil && raw != "" && strings.EqualFold(u.Hostname(), host) {
+				return true
+			}
+		}
+	}
+	for _, scheme := range []string{"http", "https"} {
+		req := &http.Request{URL: &url.URL{Scheme: scheme, Host: "habr.com"}}
+		if proxy, err := http.ProxyFromEnvironment(req); err == nil && proxy != nil && strings.EqualFold(proxy.Hostname(), host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Bot) Start() {
+	if b.bot == nil {
+		// In web-only mode, don't start the Telegram bot
+		log.Println("Running in web-only mode - Telegram bot disabled")
+		// Keep the cleanup goroutine running
+		go func() {
+			ticker := time.NewTicker(1 * time.Hour) // Clean up every hour
+			defer ticker.Stop()
+			for range ticker.C {
+				b.cleanupExpiredArticles()
+				b.cleanupChatSends()
+				b.history.Prune(b.clock.Now().Add(-b.historyRetention))
+				b.archiveHistory()
+				log.Println("Cleaned up expired articles")
+			}
+		}()
+		
+		// Wait indefinitely since there's no bot to run
+		select {}
+	}
+	
+	log.Printf("Authorized on account %s", b.bot.Self.UserName)
+
+	if b.pollInterval > 0 {
+		log.Printf("Polling feeds every %s for %d push chats", b.pollInterval, len(b.pushChats()))
+		go b.runPoller()
+	}
+	go b.runScheduler()
+
+	// Start periodic cleanup of expired articles
+	go func() {
+		ticker := time.NewTicker(1 * time.Hour) // Clean up every hour
+		defer ticker.Stop()
+		for range ticker.C {
+			b.cleanupExpiredArticles()
+			b.cleanupChatSends()
+			b.history.Prune(b.clock.Now().Add(-b.historyRetention))
+			b.archiveHistory()
+			log.Println("Cleaned up expired articles")
+		}
+	}()
+
+	u := tgbotapi.NewUpdate(0)
+	u.Timeout = 60
+
+	updates, err := b.bot.GetUpdatesChan(u)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	for update := range updates {
+		if update.Message != nil {
+			// Timed from here so /ping includes any wait before dispatch
+			go b.handleMessage(update.Message, b.clock.Now())
+		}
+	}
+}
+
+func (b *Bot) handleMessage(msg *tgbotapi.Message, receivedAt time.Time) {
+	// Telegram announces a group upgrade with a service message in the old chat
+	if msg.MigrateToChatID != 0 {
+		b.migrateChat(msg.Chat.ID, msg.MigrateToChatID)
+		return
+	}
+	if !b.limiter.Allow() {
+		return
+	}
+
+	chatID := msg.Chat.ID
+	command, mention, args := parseCommand(msg.Text, b.bot.Self.UserName)
+
+	// Admin commands keep working in maintenance mode
+	switch command {
+	case "/maintenance":
+		b.handleMaintenanceCommand(msg, args)
+		return
+	case "/listfeeds":
+		b.handleListFeedsCommand(msg)
+		return
+	case "/removefeed":
+		b.handleRemoveFeedCommand(msg, args)
+		return
+	case "/diag":
+		b.handleDiagCommand(msg)
+		return
+	case "/ping":
+		// A liveness check, so it answers during maintenance too
+		b.handlePingCommand(chatID, receivedAt)
+		return
+	}
+	if b.maintenance.Load() {
+		b.sendMaintenanceMessage(chatID)
+		return
+	}
+
+	switch command {
+	case "/start":
+		b.sendWelcomeMessage(chatID)
+	case "/help":
+		b.sendHelpMessage(chatID)
+	case "/alert":
+		b.handleAlertCommand(chatID, args)
+	case "/weekly":
+		b.handleWeeklyCommand(chatID, args)
+	case "/summarylen":
+		b.handleSummaryLenCommand(chatID, args)
+	case "/settings":
+		b.handleSettingsCommand(chatID)
+	case "/infosec", "/security":
+		hub, ok := hubFromArgs(mention, args)
+		if !ok {
+			b.sendUnknownHubMessage(chatID, hub)
+			return
+		}
+		if hub == "" || hub == defaultHub {
+			b.sendInfoSecFeed(chatID)
+		} else {
+			b.sendHubPeek(chatID, hub)
+		}
+	default:
+		b.sendWelcomeMessage(chatID)
+	}
+}
+
+// isAdmin reports whether the message was sent by a configured admin
+func (b *Bot) isAdmin(msg *tgbotapi.Message) bool {
+	return msg.From != nil && b.adminIDs[int64(msg.From.ID)]
+}
+
+// requireAdmin reports whether the message comes from an admin and tells
+// the sender off otherwise
+func (b *Bot) requireAdmin(msg *tgbotapi.Message) bool {
+	if b.isAdmin(msg) {
+		return true
+	}
+	reply := tgbotapi.NewMessage(msg.Chat.ID, "Эта команда доступна только администраторам.")
+	b.send("error", reply)
+	return false
+}
+
+// handleMaintenanceCommand implements "/maintenance on|off" for admins.
+// Without an argument it reports the current state
+func (b *Bot) handleMaintenanceCommand(msg *tgbotapi.Message, args []string) {
+	chatID := msg.Chat.ID
+	if !b.requireAdmin(msg) {
+		return
+	}
+
+	var text string
+	switch {
+	case len(args) == 0:
+		text = "Режим обслуживания выключен."
+		if b.maintenance.Load() {
+			text = "Режим обслуживания включён."
+		}
+	case args[0] == "on":
+		b.maintenance.Store(true)
+		log.Printf("Maintenance mode enabled by user %d", msg.From.ID)
+		text = "Режим обслуживания включён. Команды пользователей и API приостановлены."
+	case args[0] == "off":
+		b.maintenance.Store(false)
+		log.Printf("Maintenance mode disabled by user %d", msg.From.ID)
+		text = "Режим обслуживания выключен. Бот работает в обычном режиме."
+	default:
+		text = "Использование: /maintenance on|off"
+	}
+
+	reply := tgbotapi.NewMessage(chatID, text)
+	if _, err := b.send("notice", reply); err != nil {
+		log.Printf("Error sending maintenance reply: %v", err)
+	}
+}
+
+// handleListFeedsCommand replies with the numbered list of configured feeds
+func (b *Bot) handleListFeedsCommand(msg *tgbotapi.Message) {
+	if !b.requireAdmin(msg) {
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString("Подключённые ленты:\n")
+	for i, feed := range b.listFeeds() {
+		fmt.Fprintf(&sb, "%d. %s (вес %d) — %s\n", i+1, feed.Name, feed.Weight, feed.URL)
+		if feed.FallbackURL != "" {
+			fmt.Fprintf(&sb, "   резервный адрес: %s\n", feed.FallbackURL)
+		}
+	}
+	sb.WriteString("\nУдалить ленту: /removefeed <номер или имя>")
+
+	reply := tgbotapi.NewMessage(msg.Chat.ID, sb.String())
+	reply.DisableWebPagePreview = true
+	if _, err := b.send("notice", reply); err != nil {
+		log.Printf("Error sending feed list: %v", err)
+	}
+}
+
+// handleRemoveFeedCommand implements "/removefeed <n|name>". The removal
+// only happens once repeated with "confirm", since it also wipes the
+// feed's dedup history
+func (b *Bot) handleRemoveFeedCommand(msg *tgbotapi.Message, args []string) {
+	chatID := msg.Chat.ID
+	if !b.requireAdmin(msg) {
+		return
+	}
+
+	var text string
+	if len(args) == 0 {
+		text = "Использование: /removefeed <номер или имя>. Список лент: /listfeeds"
+	} else if feed, ok := b.findFeed(args[0]); !ok {
+		text = fmt.Sprintf("Лента «%s» не найдена. Список лент: /listfeeds", args[0])
+	} else if len(args) < 2 || args[1] != "confirm" {
+		text = fmt.Sprintf("Удалить ленту «%s» (%s)? Для подтверждения отправьте:\n/removefeed %s confirm", feed.Name, feed.URL, feed.Name)
+	} else if err := b.removeFeed(feed.Name); errors.Is(err, errLastFeed) {
+		text = "Нельзя удалить последнюю ленту."
+	} else if err != nil {
+		log.Printf("Error removing feed %s: %v", feed.Name, err)
+		text = fmt.Sprintf("Не удалось удалить ленту «%s».", feed.Name)
+	} else {
+		log.Printf("Feed %s removed by user %d", feed.Name, msg.From.ID)
+		text = fmt.Sprintf("Лента «%s» удалена.", feed.Name)
+	}
+
+	reply := tgbotapi.NewMessage(chatID, text)
+	reply.DisableWebPagePreview = true
+	if _, err := b.send("notice", reply); err != nil {
+		log.Printf("Error sending remove feed reply: %v", err)
+	}
+}
+
+// handleDiagCommand replies with a compact runtime snapshot for admins:
+// memory, goroutines and the sizes of the bot's in-memory state
+func (b *Bot) handleDiagCommand(msg *tgbotapi.Message) {
+	if !b.requireAdmin(msg) {
+		return
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	b.feedCacheMux.Lock()
+	cachedFeeds, cachedArticles := len(b.feedCache), 0
+	for _, entry := range b.feedCache {
+		cachedArticles += len(entry.articles)
+	}
+	b.feedCacheMux.Unlock()
+
+	text := fmt.Sprintf("Диагностика:\n"+
+		"Память: alloc %s, sys %s, GC %d\n"+
+		"Горутины: %d\n"+
+		"Дедупликация: %d записей /infosec, %d записей рассылки\n"+
+		"Кэш лент: %d лент, %d статей\n"+
+		"Подписчики: %d\n"+
+		"Настройки чатов: %d",
+		formatBytes(mem.Alloc), formatBytes(mem.Sys), mem.NumGC,
+		runtime.NumGoroutine(),
+		b.seen.Len(), b.pushed.Len(),
+		cachedFeeds, cachedArticles,
+		b.subscriberCount(),
+		b.settings.Len(),
+	)
+
+	reply := tgbotapi.NewMessage(msg.Chat.ID, text)
+	if _, err := b.send("notice", reply); err != nil {
+		log.Printf("Error sending diag reply: %v", err)
+	}
+}
+
+// handlePingCommand replies with how long the bot took from receiving the
+// update to being ready to reply, how long the last feed download took and
+// the bot's uptime
+func (b *Bot) handlePingCommand(chatID int64, receivedAt time.Time) {
+	fetch := "ещё не было"
+	if d := time.Duration(b.lastFetchLatency.Load()); d > 0 {
+		fetch = formatLatency(d)
+	}
+	text := fmt.Sprintf("Понг!\n"+
+		"Время ответа: %s\n"+
+		"Последняя загрузка ленты: %s\n"+
+		"Время работы: %s",
+		formatLatency(b.clock.Now().Sub(receivedAt)),
+		fetch,
+		formatUptime(time.Since(b.startedAt)),
+	)
+
+	reply := tgbotapi.NewMessage(chatID, text)
+	if _, err := b.send("notice", reply); err != nil {
+		log.Printf("Error sending ping reply: %v", err)
+	}
+}
+
+// formatLatency renders a short duration in milliseconds
+func formatLatency(d time.Duration) string {
+	return fmt.Sprintf("%.1f мс", float64(d)/float64(time.Millisecond))
+}
+
+// formatUptime renders a duration as days, hours and minutes
+func formatUptime(d time.Duration) string {
+	d = d.Truncate(time.Minute)
+	days := int(d / (24 * time.Hour))
+	hours := int(d % (24 * time.Hour) / time.Hour)
+	minutes := int(d % time.Hour / time.Minute)
+	if days > 0 {
+		return fmt.Sprintf("%d д %d ч %d мин", days, hours, minutes)
+	}
+	if hours > 0 {
+		return fmt.Sprintf("%d ч %d мин", hours, minutes)
+	}
+	return fmt.Sprintf("%d мин", minutes)
+}
+
+// subscriberCount returns how many chats receive pushes from the poller
+func (b *Bot) subscriberCount() int {
+	chats := make(map[int64]bool)
+	for _, chatID := range b.pushChats() {
+		chats[chatID] = true
+	}
+	b.settings.Range(func(chatID int64, cs ChatSettings) {
+		if cs.AlertSeverity != "" {
+			chats[chatID] = true
+		}
+	})
+	return len(chats)
+}
+
+// formatBytes renders a byte count as a short human-readable string
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func (b *Bot) sendMaintenanceMessage(chatID int64) {
+	msg := tgbotapi.NewMessage(chatID, "Бот временно находится на техническом обслуживании. Пожалуйста, попробуйте позже.")
+	_, err := b.send("notice", msg)
+	if err != nil {
+		log.Printf("Error sending maintenance message: %v", err)
+	}
+}
+
+// Bounds for the per-chat summary length set with /summarylen
+const (
+	minSummaryLength = 50
+	maxSummaryLength = 1000
+)
+
+// handleSummaryLenCommand implements "/summarylen <n>", which sets the
+// chat's summary length clamped to [minSummaryLength, maxSummaryLength],
+// and "/summarylen default". Without an argument it shows the current value
+func (b *Bot) handleSummaryLenCommand(chatID int64, args []string) {
+	var text string
+	switch {
+	case len(args) == 0:
+		current := b.settings.Get(chatID).SummaryLength
+		if current == 0 {
+			text = fmt.Sprintf("Длина описания: %d символов (по умолчанию).", b.summaryLength)
+		} else {
+			text = fmt.Sprintf("Длина описания: %d символов.", current)
+		}
+		text += fmt.Sprintf("\nИзменить: /summarylen <%d–%d>, сбросить: /summarylen default", minSummaryLength, maxSummaryLength)
+	case args[0] == "default":
+		b.settings.Update(chatID, func(cs *ChatSettings) { cs.SummaryLength = 0 })
+		text = fmt.Sprintf("Длина описания сброшена до значения по умолчанию: %d символов.", b.summaryLength)
+	default:
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			text = fmt.Sprintf("Использование: /summarylen <%d–%d> или /summarylen default", minSummaryLength, maxSummaryLength)
+			break
+		}
+		if n < minSummaryLength {
+			n = minSummaryLength
+		} else if n > maxSummaryLength {
+			n = maxSummaryLength
+		}
+		b.settings.Update(chatID, func(cs *ChatSettings) { cs.SummaryLength = n })
+		text = fmt.Sprintf("Длина описания установлена: %d символов.", n)
+	}
+
+	msg := tgbotapi.NewMessage(chatID, text)
+	if _, err := b.send("notice", msg); err != nil {
+		log.Printf("Error sending summary length reply: %v", err)
+	}
+}
+
+// handleSettingsCommand shows the chat's settings in one message, each
+// with the command that changes it
+func (b *Bot) handleSettingsCommand(chatID int64) {
+	cs := b.settings.Get(chatID)
+
+	summary := fmt.Sprintf("%d символов (по умолчанию)", b.summaryLength)
+	if cs.SummaryLength != 0 {
+		summary = fmt.Sprintf("%d символов", cs.SummaryLength)
+	}
+	alert := "выключены"
+	if cs.AlertSeverity != "" {
+		alert = fmt.Sprintf("уровень %s и выше", cs.AlertSeverity)
+	}
+	weekly := "выключена"
+	if cs.Weekly != nil {
+		weekly = fmt.Sprintf("%d статей, %s в %02d:%02d", cs.Weekly.Count, weekdayLabels[cs.Weekly.Day], cs.Weekly.Hour, cs.Weekly.Minute)
+	}
+
+	text := "Настройки чата:\n" +
+		fmt.Sprintf("Длина описания: %s — /summarylen <%d–%d>, /summarylen default\n", summary, minSummaryLength, maxSummaryLength) +
+		fmt.Sprintf("Оповещения: %s — /alert <low|medium|high|critical>, /alert off\n", alert) +
+		fmt.Sprintf("Еженедельная подборка: %s — /weekly <число> <день> <ЧЧ:ММ>, /weekly off", weekly)
+	for _, pushChatID := range b.pushChats() {
+		if pushChatID == chatID {
+			text += "\nЧат получает все новые статьи автоматически (настраивается администратором)."
+			break
+		}
+	}
+
+	msg := tgbotapi.NewMessage(chatID, text)
+	if _, err := b.send("notice", msg); err != nil {
+		log.Printf("Error sending settings reply: %v", err)
+	}
+}
+
+// handleAlertCommand implements "/alert <low|medium|high|critical>", which
+// subscribes the chat to real-time pushes of articles at or above that
+// severity, and "/alert off". Without an argument it shows the current state
+func (b *Bot) handleAlertCommand(chatID int64, args []string) {
+	var text string
+	switch {
+	case len(args) == 0:
+		current := b.settings.Get(chatID).AlertSeverity
+		if current == "" {
+			text = "Оповещения выключены."
+		} else {
+			text = fmt.Sprintf("Оповещения включены для статей с уровнем %s и выше.", current)
+		}
+		text += "\nИзменить: /alert <low|medium|high|critical>, выключить: /alert off"
+	case args[0] == "off":
+		b.settings.Update(chatID, func(cs *ChatSettings) { cs.AlertSeverity = "" })
+		text = "Оповещения выключены."
+	default:
+		severity, ok := parseSeverity(strings.ToLower(args[0]))
+		if !ok {
+			text = "Использование: /alert <low|medium|high|critical> или /alert off"
+			break
+		}
+		b.settings.Update(chatID, func(cs *ChatSettings) { cs.AlertSeverity = severity.String() })
+		text = fmt.Sprintf("Оповещения включены: новые статьи с уровнем %s и выше будут приходить автоматически.", severity)
+		if b.pollInterval == 0 {
+			text += "\nФоновый опрос лент сейчас отключён, поэтому оповещения начнут приходить после его включения администратором."
+		}
+	}
+
+	msg := tgbotapi.NewMessage(chatID, text)
+	if _, err := b.send("notice", msg); err != nil {
+		log.Printf("Error sending alert reply: %v", err)
+	}
+}
+
+// maxWeeklyCount caps the number of articles in a weekly roundup
+const maxWeeklyCount = 20
+
+// weekdayNames maps the day names /weekly accepts to weekdays
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+	"вс": time.Sunday, "пн": time.Monday, "вт": time.Tuesday, "ср": time.Wednesday,
+	"чт": time.Thursday, "пт": time.Friday, "сб": time.Saturday,
+}
+
+// weekdayLabels are the Russian short names indexed by time.Weekday
+var weekdayLabels = []string{"вс", "пн", "вт", "ср", "чт", "пт", "сб"}
+
+// handleWeeklyCommand implements "/weekly <count> <day> <HH:MM>", which
+// schedules a weekly roundup of the top articles for the chat, and
+// "/weekly off". Without arguments it shows the current schedule
+func (b *Bot) handleWeeklyCommand(chatID int64, args []string) {
+	usage := fmt.Sprintf("Использование: /weekly <1–%d> <пн–вс или mon–sun> <ЧЧ:ММ>, например /weekly 5 пн 09:00. Выключить: /weekly off", maxWeeklyCount)
+
+	var text string
+	switch {
+	case len(args) == 0:
+		weekly := b.settings.Get(chatID).Weekly
+		if weekly == nil {
+			text = "Еженедельная подборка выключена.\n" + usage
+		} else {
+			text = fmt.Sprintf("Еженедельная подборка: %d статей, %s в %02d:%02d.\nВыключить: /weekly off",
+				weekly.Count, weekdayLabels[weekly.Day], weekly.Hour, weekly.Minute)
+		}
+	case args[0] == "off":
+		b.settings.Update(chatID, func(cs *ChatSettings) { cs.Weekly = nil })
+		text = "Еженедельная подборка выключена."
+	case len(args) == 3:
+		count, err := strconv.Atoi(args[0])
+		day, dayOK := weekdayNames[strings.ToLower(args[1])]
+		at, timeErr := time.Parse("15:04", args[2])
+		if err != nil || !dayOK || timeErr != nil {
+			text = usage
+			break
+		}
+		if count < 1 {
+			count = 1
+		} else if count > maxWeeklyCount {
+			count = maxWeeklyCount
+		}
+
+		// Counting from now means a time earlier today doesn't fire at once
+		weekly := &WeeklyRoundup{Count: count, Day: day, Hour: at.Hour(), Minute: at.Minute(), LastSent: b.clock.Now()}
+		b.settings.Update(chatID, func(cs *ChatSettings) { cs.Weekly = weekly })
+		text = fmt.Sprintf("Еженедельная подборка включена: %d статей, %s в %02d:%02d.", count, weekdayLabels[day], weekly.Hour, weekly.Minute)
+		if b.pollInterval == 0 {
+			text += "\nФоновый опрос лент сейчас отключён, поэтому в подборку попадут только статьи, запрошенные через /infosec или API. Для полной подборки администратору нужно включить опрос."
+		}
+	default:
+		text = usage
+	}
+
+	msg := tgbotapi.NewMessage(chatID, text)
+	if _, err := b.send("notice", msg); err != nil {
+		log.Printf("Error sending weekly reply: %v", err)
+	}
+}
+
+// runScheduler checks scheduled per-chat jobs once a minute until the
+// process exits. Jobs are held back while maintenance mode is on
+func (b *Bot) runScheduler() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		if b.maintenance.Load() {
+			continue
+		}
+		b.runScheduledJobs(b.clock.Now())
+	}
+}
+
+// runScheduledJobs sends every weekly roundup that is due at now
+func (b *Bot) runScheduledJobs(now time.Time) {
+	due := make(map[int64]WeeklyRoundup)
+	b.settings.Range(func(chatID int64, cs ChatSettings) {
+		if cs.Weekly != nil && cs.Weekly.due(now) {
+			due[chatID] = *cs.Weekly
+		}
+	})
+
+	for chatID, weekly := range due {
+		b.sendWeeklyRoundup(chatID, weekly.Count, now)
+
+		sent := weekly
+		sent.LastSent = now
+		b.settings.Update(chatID, func(cs *ChatSettings) {
+			// The chat may have changed or disabled its schedule meanwhile
+			if cs.Weekly != nil && cs.Weekly.Day == sent.Day && cs.Weekly.Hour == sent.Hour && cs.Weekly.Minute == sent.Minute {
+				updated := *cs.Weekly
+				updated.LastSent = sent.LastSent
+				cs.Weekly = &updated
+			}
+		})
+	}
+}
+
+// weeklyTopArticles ranks the articles published in the week before now
+// and returns the top count. Ranking is by recency for now, with feed
+// weight breaking ties
+func weeklyTopArticles(history []Article, weights map[string]int, now time.Time, count int) []Article {
+	weekAgo := now.AddDate(0, 0, -7)
+	var week []Article
+	for _, article := range history {
+		if article.Date.After(weekAgo) && !article.Date.After(now) {
+			week = append(week, article)
+		}
+	}
+	sortArticles(week, weights)
+	if len(week) > count {
+		week = week[:count]
+	}
+	return week
+}
+
+// sendWeeklyRoundup sends the chat a single message listing the week's top
+// articles. Nothing is sent when the week had none
+func (b *Bot) sendWeeklyRoundup(chatID int64, count int, now time.Time) {
+	history := b.history.Since(now.AddDate(0, 0, -7))
+	top := weeklyTopArticles(history, feedWeights(b.listFeeds()), now, count)
+	if len(top) == 0 {
+		log.Printf("No articles for the weekly roundup of chat %d", chatID)
+		return
+	}
+
+	text := "📰 <b>Главное за неделю</b>\n"
+	for i, article := range top {
+		line := fmt.Sprintf("\n%d. <a href=\"%s\">%s</a>", i+1, html.EscapeString(article.Link), html.EscapeString(article.Title))
+		if utf8.RuneCountInString(text+line) > telegramMaxMessageLength {
+			break
+		}
+		text += line
+	}
+
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ParseMode = "HTML"
+	msg.DisableWebPagePreview = true
+	if _, err := b.send("roundup", msg); err != nil {
+		log.Printf("Error sending weekly roundup to chat %d: %v", chatID, err)
+	}
+}
+
+// chatSummary returns the article summary trimmed to the chat's preferred
+// length, or the default summary when the chat hasn't set one
+func (b *Bot) chatSummary(chatID int64, article Article) string {
+	n := b.settings.Get(chatID).SummaryLength
+	if n == 0 || n == b.summaryLength || article.Content == "" {
+		return article.Summary
+	}
+	return b.trimSummary(article.Content, n)
+}
+
+// parseCommand splits a message like "/infosec@go topic:go" into the
+// command ("/infosec"), the part after "@" ("go") and the remaining
+// arguments. Text that isn't a command yields an empty command. In groups
+// "/cmd@BotName" addresses this bot rather than naming a hub, so a mention
+// of botName is dropped
+func parseCommand(text, botName string) (command, mention string, args []string) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "/") {
+		return "", "", nil
+	}
+
+	command = strings.ToLower(fields[0])
+	if i := strings.Index(command, "@"); i != -1 {
+		command, mention = command[:i], command[i+1:]
+	}
+	if strings.EqualFold(mention, botName) {
+		mention = ""
+	}
+	return command, mention, fields[1:]
+}
+
+// hubFromArgs picks the hub requested via "/infosec@<hub>" or
+// "/infosec topic:<hub>". It returns "" with ok set when no hub was asked
+// for, and the requested name with ok unset when it isn't in the allowlist
+func hubFromArgs(mention string, args []string) (hub string, ok bool) {
+	hub = mention
+	for _, arg := range args {
+		if strings.HasPrefix(strings.ToLower(arg), "topic:") {
+			hub = arg[len("topic:"):]
+		}
+	}
+
+	hub = strings.ToLower(hub)
+	if hub == "" {
+		return "", true
+	}
+	_, ok = habrHubs[hub]
+	return hub, ok
+}
+
+// Safe method to check if an article was already sent according to store
+func (b *Bot) wasArticleSent(store SeenStore, key string) bool {
+	b.articlesMux.Lock() // Need write lock because we might cleanup
+	defer b.articlesMux.Unlock()
+	
+	// Check if article exists
+	if entry, ok := store.Get(key); ok {
+		// Check if the article has expired
+		if b.clock.Now().Sub(entry.SentAt) > b.articleExpiry {
+			// Remove expired article
+			store.Delete(key)
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// articleUpdateDue reports whether a sent article's content differs from
+// what was last sent and the article hasn't been (re)sent within the
+// renotify interval. Edits made during the interval are coalesced into one
+// notification once it passes. Entries without a stored hash never count
+// as changed
+func (b *Bot) articleUpdateDue(store SeenStore, key, contentHash string) bool {
+	b.articlesMux.RLock()
+	defer b.articlesMux.RUnlock()
+
+	entry, ok := store.Get(key)
+	if !ok || entry.ContentHash == "" || entry.ContentHash == contentHash {
+		return false
+	}
+
+	lastNotified := entry.SentAt
+	if entry.RenotifiedAt.After(lastNotified) {
+		lastNotified = entry.RenotifiedAt
+	}
+	return b.clock.Now().Sub(lastNotified) >= b.renotifyInterval
+}
+
+// markArticleUpdated records that an updated article was sent again. The
+// original send time is kept so the dedup expiry isn't extended. It reports
+// false if the update was already recorded by someone else
+func (b *Bot) markArticleUpdated(store SeenStore, key, contentHash string) bool {
+	b.articlesMux.Lock()
+	defer b.articlesMux.Unlock()
+
+	entry, _ := store.Get(key)
+	if entry.ContentHash == contentHash {
+		return false
+	}
+	entry.ContentHash = contentHash
+	entry.RenotifiedAt = b.clock.Now()
+	store.Put(key, entry)
+	return true
+}
+
+// Safe method to mark an article as sent, remembering which feed it came
+// from and a hash of its content for update detection. It reports false,
+// leaving the store untouched, if the article was already marked
+func (b *Bot) markArticleIfNew(store SeenStore, key, feed, contentHash string) bool {
+	return store.MarkIfNew(key, SeenEntry{
+		SentAt:      b.clock.Now(),
+		Feed:        feed,
+		ContentHash: contentHash,
+	}, b.articleExpiry)
+}
+
+// forgetFeedArticles drops the dedup entries of articles from the feed.
+// Articles that owners says another feed carries too are kept, attributed
+// to that feed, so they aren't sent again
+func (b *Bot) forgetFeedArticles(feed string, owners map[string]string) int {
+	b.articlesMux.Lock()
+	defer b.articlesMux.Unlock()
+
+	forgotten := 0
+	for _, store := range b.dedupStores() {
+		var keys []string
+		moved := make(map[string]SeenEntry)
+		store.Range(func(key string, entry SeenEntry) {
+			if entry.Feed != feed {
+				return
+			}
+			if owner, ok := owners[key]; ok {
+				entry.Feed = owner
+				moved[key] = entry
+			} else {
+				keys = append(keys, key)
+			}
+		})
+		for key, entry := range moved {
+			store.Put(key, entry)
+		}
+		store.Delete(keys...)
+		forgotten += len(keys)
+	}
+	return forgotten
+}
+
+// dedupStores returns the stores tracking sent articles: the one behind
+// /infosec and the one behind pushes
+func (b *Bot) dedupStores() []SeenStore {
+	return []SeenStore{b.seen, b.pushed}
+}
+
+// feedArticleOwners maps the IDs of articles known to appear in the feeds,
+// from the feed cache and the history, to the name of a feed carrying them
+func (b *Bot) feedArticleOwners(feeds []FeedSource) map[string]string {
+	owners := make(map[string]string)
+	names := make(map[string]bool)
+	b.feedCacheMux.Lock()
+	for _, feed := range feeds {
+		names[feed.Name] = true
+		if entry, ok := b.feedCache[feed.URL]; ok {
+			for _, article := range entry.articles {
+				owners[article.ID()] = feed.Name
+			}
+		}
+	}
+	b.feedCacheMux.Unlock()
+
+	for _, entry := range b.history.Entries() {
+		if _, ok := owners[entry.ID()]; !ok && names[entry.Feed] {
+			owners[entry.ID()] = entry.Feed
+		}
+	}
+	return owners
+}
+
+// Clean up expired articles periodically
+func (b *Bot) cleanupExpiredArticles() {
+	b.articlesMux.Lock()
+	defer b.articlesMux.Unlock()
+	
+	now := b.clock.Now()
+	for _, store := range b.dedupStores() {
+		var keys []string
+		store.Range(func(key string, entry SeenEntry) {
+			if now.Sub(entry.SentAt) > b.articleExpiry {
+				keys = append(keys, key)
+			}
+		})
+		store.Delete(keys...)
+	}
+}
+
+// archiveHistory strips the text from history entries older than
+// historyArchiveAfter, if archiving is enabled
+func (b *Bot) archiveHistory() {
+	if b.historyArchiveAfter <= 0 {
+		return
+	}
+	if n := b.history.Archive(b.clock.Now().Add(-b.historyArchiveAfter)); n > 0 {
+		log.Printf("Archived %d history entries", n)
+	}
+}
+
+// send delivers a message through the sender and records how long the call
+// took under the given message type (article, welcome, error, ...)
+func (b *Bot) send(kind string, c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	start := time.Now()
+	msg, err := b.sender.Send(c)
+	b.sendLatency.Observe(kind, time.Since(start))
+
+	// A group upgraded to a supergroup gets a new ID and Telegram refuses
+	// sends to the old one. Follow the chat and resend. Only plain messages
+	// are retried: message IDs don't carry over, so deletes can't be
+	if apiErr, ok := err.(tgbotapi.Error); ok && apiErr.MigrateToChatID != 0 {
+		if m, ok := c.(tgbotapi.MessageConfig); ok {
+			b.migrateChat(m.ChatID, apiErr.MigrateToChatID)
+			m.ChatID = apiErr.MigrateToChatID
+			start = time.Now()
+			msg, err = b.sender.Send(m)
+			b.sendLatency.Observe(kind, time.Since(start))
+		}
+	}
+	return msg, err
+}
+
+// pushChats returns a copy of the chats that receive poller pushes
+func (b *Bot) pushChats() []int64 {
+	b.pushChatsMux.RLock()
+	defer b.pushChatsMux.RUnlock()
+
+	return append([]int64(nil), b.pushChatIDs...)
+}
+
+// migrateChat moves everything kept for a chat to its new ID after
+// Telegram migrated it: settings and subscriptions, push chat membership,
+// the overflow queue, hourly send counts and cap notices
+func (b *Bot) migrateChat(oldID, newID int64) {
+	if oldID == newID {
+		return
+	}
+	log.Printf("Chat %d migrated to %d, moving its settings and subscriptions", oldID, newID)
+
+	b.settings.Move(oldID, newID)
+
+	b.pushChatsMux.Lock()
+	for i, chatID := range b.pushChatIDs {
+		if chatID == oldID {
+			b.pushChatIDs[i] = newID
+			log.Printf("Push chat %d is now %d; update PUSH_CHAT_IDS to keep it after a restart", oldID, newID)
+		}
+	}
+	b.pushChatsMux.Unlock()
+
+	b.chatSendsMux.Lock()
+	if queue, ok := b.deferredArticles[oldID]; ok {
+		b.deferredArticles[newID] = append(b.deferredArticles[newID], queue...)
+		delete(b.deferredArticles, oldID)
+	}
+	if sends, ok := b.chatSends[oldID]; ok {
+		b.chatSends[newID] = mergeSends(b.chatSends[newID], sends)
+		delete(b.chatSends, oldID)
+	}
+	if at, ok := b.overflowNotices[oldID]; ok {
+		if at.After(b.overflowNotices[newID]) {
+			b.overflowNotices[newID] = at
+		}
+		delete(b.overflowNotices, oldID)
+	}
+	b.chatSendsMux.Unlock()
+}
+
+// mergeSends merges two ordered lists of send times into one, as
+// pruneSends expects
+func mergeSends(a, b []time.Time) []time.Time {
+	merged := make([]time.Time, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		if b[0].Before(a[0]) {
+			merged, b = append(merged, b[0]), b[1:]
+		} else {
+			merged, a = append(merged, a[0]), a[1:]
+		}
+	}
+	merged = append(merged, a...)
+	return append(merged, b...)
+}
+
+// allowChatSend reports whether another article may be pushed to the chat
+// under its hourly cap and, if so, records the send. The window is rolling:
+// only sends within the last hour count towards the cap
+func (b *Bot) allowChatSend(chatID int64) bool {
+	if b.chatHourlyCap <= 0 {
+		return true
+	}
+
+	b.chatSendsMux.Lock()
+	defer b.chatSendsMux.Unlock()
+
+	now := b.clock.Now()
+	sends := pruneSends(b.chatSends[chatID], now.Add(-time.Hour))
+	if len(sends) >= b.chatHourlyCap {
+		b.chatSends[chatID] = sends
+		return false
+	}
+	b.chatSends[chatID] = append(sends, now)
+	return true
+}
+
+// pruneSends drops send times at or before cutoff; sends are kept in order
+func pruneSends(sends []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(sends) && !sends[i].After(cutoff) {
+		i++
+	}
+	return sends[i:]
+}
+
+// deferArticles queues articles that didn't fit under the chat's hourly cap
+func (b *Bot) deferArticles(chatID int64, articles []Article) {
+	b.chatSendsMux.Lock()
+	defer b.chatSendsMux.Unlock()
+
+	queue := append(b.deferredArticles[chatID], articles...)
+	if len(queue) > maxDeferredArticles {
+		queue = queue[len(queue)-maxDeferredArticles:]
+	}
+	b.deferredArticles[chatID] = queue
+}
+
+// takeDeferredArticles returns and clears the chat's overflow queue
+func (b *Bot) takeDeferredArticles(chatID int64) []Article {
+	b.chatSendsMux.Lock()
+	defer b.chatSendsMux.Unlock()
+
+	articles := b.deferredArticles[chatID]
+	delete(b.deferredArticles, chatID)
+	return articles
+}
+
+// Clean up send history for chats that have been quiet for an hour
+func (b *Bot) cleanupChatSends() {
+	b.chatSendsMux.Lock()
+	defer b.chatSendsMux.Unlock()
+
+	cutoff := b.clock.Now().Add(-time.Hour)
+	for chatID, sends := range b.chatSends {
+		if sends = pruneSends(sends, cutoff); len(sends) == 0 {
+			delete(b.chatSends, chatID)
+		} else {
+			b.chatSends[chatID] = sends
+		}
+	}
+	for chatID, at := range b.overflowNotices {
+		if !at.After(cutoff) {
+			delete(b.overflowNotices, chatID)
+		}
+	}
+}
+
+// handleChatOverflow defers or drops the articles over the hourly cap and
+// lets the chat know, at most once per hour so a capped chat isn't sent a
+// notice on every poll cycle
+func (b *Bot) handleChatOverflow(chatID int64, overflow []Article) {
+	text := fmt.Sprintf("Достигнут лимит в %d статей в час. Пропущено статей: %d.", b.chatHourlyCap, len(overflow))
+	if b.deferOverflow {
+		b.deferArticles(chatID, overflow)
+		text = fmt.Sprintf("Достигнут лимит в %d статей в час. Ещё %d статей будут отправлены позже: со следующей рассылкой или по команде /infosec.", b.chatHourlyCap, len(overflow))
+	}
+
+	b.chatSendsMux.Lock()
+	now := b.clock.Now()
+	notified := now.Sub(b.overflowNotices[chatID]) < time.Hour
+	if !notified {
+		b.overflowNotices[chatID] = now
+	}
+	b.chatSendsMux.Unlock()
+	if notified {
+		return
+	}
+
+	msg := tgbotapi.NewMessage(chatID, text)
+	if _, err := b.send("notice", msg); err != nil {
+		log.Printf("Error sending overflow message: %v", err)
+	}
+}
+
+func (b *Bot) sendWelcomeMessage(chatID int64) {
+	msg := tgbotapi.NewMessage(chatID, "Привет! Я бот, который предоставляет RSS-ленту статей с Хабра по теме информационной безопасности.\n\nДоступные команды:\n/infosec или /security - получить последние статьи по информационной безопасности")
+	_, err := b.send("welcome", msg)
+	if err != nil {
+		log.Printf("Error sending welcome message: %v", err)
+	}
+}
+
+func (b *Bot) sendHelpMessage(chatID int64) {
+	helpText := "Доступные команды:\n" +
+		"/infosec или /security - получить последние статьи по информационной безопасности\n" +
+		"/infosec@<хаб> или /infosec topic:<хаб> - разово посмотреть статьи другого хаба, например /infosec topic:go\n" +
+		"/summarylen <число> - длина описания статей в этом чате\n" +
+		"/alert <low|medium|high|critical> - присылать новые статьи от заданного уровня важности, /alert off - выключить\n" +
+		"/weekly <число> <день> <ЧЧ:ММ> - еженедельная подборка главных статей, /weekly off - выключить\n" +
+		"/settings - текущие настройки чата\n" +
+		"/ping - проверить, что бот на связи, и время его ответа\n" +
+		"/help - показать это сообщение\n" +
+		"/start - начать работу с ботом"
+
+	msg := tgbotapi.NewMessage(chatID, helpText)
+	_, err := b.send("help", msg)
+	if err != nil {
+		log.Printf("Error sending help message: %v", err)
+	}
+}
+
+func (b *Bot) sendInfoSecFeed(chatID int64) {
+	msg := tgbotapi.NewMessage(chatID, "Получаю последние статьи по информационной безопасности с Хабра...")
+	sentMsg, err := b.send("loading", msg)
+	if err != nil {
+		log.Printf("Error sending loading message: %v", err)
+		// If we can't send the loading message, try to proceed anyway
+		// Create a dummy message ID to avoid issues later
+		sentMsg = tgbotapi.Message{MessageID: 0}
+	}
+
+	articles, err := b.getHabrInfoSecFeed(true)
+	if err != nil {
+		log.Printf("Error getting Habr feed: %v", err)
+		errorMsg := tgbotapi.NewMessage(chatID, "Ошибка при получении статей. Пожалуйста, попробуйте позже.")
+		b.send("error", errorMsg)
+		// If we sent the loading message, try to delete it
+		if sentMsg.MessageID != 0 {
+			deleteMsg := tgbotapi.NewDeleteMessage(chatID, sentMsg.MessageID)
+			b.send("delete", deleteMsg)
+		}
+		return
+	}
+
+	// Articles held back by the hourly cap go out first. The poller tracks
+	// them in its own store, so they may be among the fresh ones too; mark
+	// them as seen here so neither this reply nor a later one repeats them
+	deferred := b.takeDeferredArticles(chatID)
+	if len(deferred) > 0 {
+		ids := make(map[string]bool, len(deferred))
+		for _, article := range deferred {
+			ids[article.ID()] = true
+			b.markArticleIfNew(b.seen, article.ID(), article.Feed, article.ContentHash)
+		}
+		fresh := articles
+		articles = deferred
+		for _, article := range fresh {
+			if !ids[article.ID()] {
+				articles = append(articles, article)
+			}
+		}
+	}
+
+	if len(articles) == 0 {
+		// If we sent the loading message, try to delete it
+		if sentMsg.MessageID != 0 {
+			deleteMsg := tgbotapi.NewDeleteMessage(chatID, sentMsg.MessageID)
+			b.send("delete", deleteMsg)
+		}
+		noArticlesMsg := tgbotapi.NewMessage(chatID, "На данный момент нет новых статей по информационной безопасности.")
+		b.send("notice", noArticlesMsg)
+		return
+	}
+
+	// Delete the "loading" message if we successfully got articles
+	if sentMsg.MessageID != 0 {
+		deleteMsg := tgbotapi.NewDeleteMessage(chatID, sentMsg.MessageID)
+		b.send("delete", deleteMsg)
+	}
+
+	b.sendArticles(chatID, articles)
+}
+
+// sendArticles delivers articles to the chat one message each, respecting
+// the chat's hourly cap
+func (b *Bot) sendArticles(chatID int64, articles []Article) {
+	for i, article := range articles {
+		if !b.allowChatSend(chatID) {
+			b.handleChatOverflow(chatID, articles[i:])
+			break
+		}
+		b.sendArticle(chatID, article)
+	}
+}
+
+// sendArticle sends one article message in the chat's summary length
+func (b *Bot) sendArticle(chatID int64, article Article) {
+	article.Summary = b.chatSummary(chatID, article)
+	blockquote := b.summaryBlockquote && !b.blockquoteUnsupported.Load()
+	articleMsg := tgbotapi.NewMessage(chatID, fitArticleMessage(article, blockquote))
+	articleMsg.ParseMode = "HTML"
+	
+	_, err := b.send("article", articleMsg)
+	if err != nil && blockquote && isUnsupportedTagError(err) {
+		// Older Bot API versions don't know <blockquote>; stop using it
+		// and resend this article as plain text
+		log.Printf("Telegram rejected blockquote formatting, falling back to plain summaries: %v", err)
+		b.blockquoteUnsupported.Store(true)
+		articleMsg.Text = fitArticleMessage(article, false)
+		_, err = b.send("article", articleMsg)
+	}
+	if err != nil {
+		log.Printf("Error sending article '%s' (guid %s): %v", article.Title, article.GUID, err)
+		return
+	}
+	
+	// Small delay between messages to avoid rate limiting
+	time.Sleep(b.sendInterval)
+}
+
+// telegramMaxMessageLength is the longest text Telegram accepts in one message
+const telegramMaxMessageLength = 4096
+
+// formatArticleMessage renders an article as an HTML-formatted message,
+// optionally wrapping the summary in a blockquote. An empty link leaves out
+// the "read more" line
+func formatArticleMessage(title, summary, link string, blockquote bool) string {
+	summaryHTML := html.EscapeString(summary)
+	if blockquote && summary != "" {
+		summaryHTML = "<blockquote>" + summaryHTML + "</blockquote>"
+	}
+	text := fmt.Sprintf("📚 <b>%s</b>\n\n%s", html.EscapeString(title), summaryHTML)
+	if link != "" {
+		text += fmt.Sprintf("\n\n🔗 <a href=\"%s\">Читать на Хабре</a>", html.EscapeString(link))
+	}
+	return text
+}
+
+// isUnsupportedTagError reports whether Telegram refused a message because
+// its HTML contains a tag the Bot API version doesn't support
+func isUnsupportedTagError(err error) bool {
+	return strings.Contains(err.Error(), "Unsupported start tag")
+}
+
+// fitArticleMessage renders the article and makes sure the result fits into
+// a single Telegram message. Telegram rejects longer messages with an
+// unhelpful error, so an oversized message is logged and its summary (and
+// if needed its title) is shortened until it fits
+func fitArticleMessage(article Article, blockquote bool) string {
+	title, summary := article.Title, article.Summary
+	if article.Updated {
+		title = "Обновлено: " + title
+	}
+	text := formatArticleMessage(title, summary, article.Link, blockquote)
+	over := utf8.RuneCountInString(text) - telegramMaxMessageLength
+	if over <= 0 {
+		return text
+	}
+
+	log.Printf("Warning: message for article '%s' (guid %s) is %d characters over the Telegram limit, truncating",
+		article.Title, article.GUID, over)
+
+	// Escaping only makes text longer, so dropping n raw characters shortens
+	// the message by at least n. One extra is dropped to make room for "…"
+	summary = cutRunes(summary, over+1)
+	text = formatArticleMessage(title, summary, article.Link, blockquote)
+	if over = utf8.RuneCountInString(text) - telegramMaxMessageLength; over > 0 {
+		title = cutRunes(title, over+1)
+		text = formatArticleMessage(title, summary, article.Link, blockquote)
+	}
+	if utf8.RuneCountInString(text) > telegramMaxMessageLength {
+		// Only the link is left to shorten, and a cut link is a broken one
+		log.Printf("Warning: link of article '%s' (guid %s) doesn't fit into a Telegram message, sending without it",
+			article.Title, article.GUID)
+		text = formatArticleMessage(title, summary, "", blockquote)
+	}
+	return text
+}
+
+// cutRunes removes up to n runes from the end of s, appending "…" when
+// anything was removed
+func cutRunes(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) == 0 {
+		return s
+	}
+	if n >= len(runes) {
+		return "…"
+	}
+	return string(runes[:len(runes)-n]) + "…"
+}
+
+// sendHubPeek fetches a hub once for the chat without touching the dedup
+// state, so the peeked articles still show up in the regular feed later
+func (b *Bot) sendHubPeek(chatID int64, hub string) {
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Получаю последние статьи из хаба «%s» с Хабра...", habrHubs[hub]))
+	sentMsg, err := b.send("loading", msg)
+	if err != nil {
+		log.Printf("Error sending loading message: %v", err)
+		sentMsg = tgbotapi.Message{MessageID: 0}
+	}
+
+	articles, err := b.cachedFeedArticles(FeedSource{Name: hub, URL: fmt.Sprintf(habrHubFeedURL, hub)})
+	// The loading message is no longer needed whatever the outcome
+	if sentMsg.MessageID != 0 {
+		deleteMsg := tgbotapi.NewDeleteMessage(chatID, sentMsg.MessageID)
+		b.send("delete", deleteMsg)
+	}
+	if err != nil {
+		log.Printf("Error getting Habr feed for hub %s: %v", hub, err)
+		errorMsg := tgbotapi.NewMessage(chatID, "Ошибка при получении статей. Пожалуйста, попробуйте позже.")
+		b.send("error", errorMsg)
+		return
+	}
+
+	if len(articles) == 0 {
+		noArticlesMsg := tgbotapi.NewMessage(chatID, "В этом хабе пока нет статей.")
+		b.send("notice", noArticlesMsg)
+		return
+	}
+
+	// Limit to 10 most recent articles
+	if len(articles) > 10 {
+		articles = articles[:10]
+	}
+	// A peek is a one-off look that leaves the chat's state alone: it
+	// doesn't count towards the hourly cap and is never deferred
+	for _, article := range articles {
+		b.sendArticle(chatID, article)
+	}
+}
+
+func (b *Bot) sendUnknownHubMessage(chatID int64, hub string) {
+	hubs := make([]string, 0, len(habrHubs))
+	for name := range habrHubs {
+		hubs = append(hubs, name)
+	}
+	sort.Strings(hubs)
+
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Неизвестный хаб «%s». Доступные хабы: %s", hub, strings.Join(hubs, ", ")))
+	_, err := b.send("error", msg)
+	if err != nil {
+		log.Printf("Error sending unknown hub message: %v", err)
+	}
+}
+
+// feedWeights maps feed names to their weights
+func feedWeights(feeds []FeedSource) map[string]int {
+	weights := make(map[string]int, len(feeds))
+	for _, feed := range feeds {
+		weights[feed.Name] = feed.Weight
+	}
+	return weights
+}
+
+// listFeeds returns a snapshot of the configured feeds
+func (b *Bot) listFeeds() []FeedSource {
+	b.feedsMux.RLock()
+	defer b.feedsMux.RUnlock()
+
+	return append([]FeedSource(nil), b.feeds...)
+}
+
+// findFeed looks a feed up by its 1-based position in listFeeds or by name
+func (b *Bot) findFeed(ref string) (FeedSource, bool) {
+	feeds := b.listFeeds()
+	if n, err := strconv.Atoi(ref); err == nil {
+		if n >= 1 && n <= len(feeds) {
+			return feeds[n-1], true
+		}
+		return FeedSource{}, false
+	}
+	for _, feed := range feeds {
+		if strings.EqualFold(feed.Name, ref) {
+			return feed, true
+		}
+	}
+	return FeedSource{}, false
+}
+
+// errLastFeed is returned when removing a feed would leave none configured
+var errLastFeed = errors.New("cannot remove the last feed")
+
+// removeFeed drops the named feed along with its cached items and dedup
+// entries. The last remaining feed can't be removed. With a seen store file
+// the removal is persisted so FEEDS doesn't bring the feed back on restart;
+// if that fails the dedup entries are kept, so a returning feed isn't resent
+func (b *Bot) removeFeed(name string) error {
+	b.feedsMux.Lock()
+	index := -1
+	for i, feed := range b.feeds {
+		if feed.Name == name {
+			index = i
+		}
+	}
+	if index == -1 {
+		b.feedsMux.Unlock()
+		return fmt.Errorf("feed %q not found", name)
+	}
+	if len(b.feeds) == 1 {
+		b.feedsMux.Unlock()
+		return errLastFeed
+	}
+	removed := b.feeds[index]
+	b.feeds = append(b.feeds[:index:index], b.feeds[index+1:]...)
+	b.removedFeeds = append(b.removedFeeds, removed.Name)
+	removedFeeds := append([]string(nil), b.removedFeeds...)
+	b.feedsMux.Unlock()
+
+	b.feedCacheMux.Lock()
+	delete(b.feedCache, removed.URL)
+	b.feedCacheMux.Unlock()
+
+	forget := true
+	if b.removedFeedsPath != "" {
+		if err := saveRemovedFeeds(b.removedFeedsPath, removedFeeds); err != nil {
+			log.Printf("Error persisting removal of feed %s, keeping its dedup entries: %v", removed.Name, err)
+			forget = false
+		}
+	}
+
+	owners := b.feedArticleOwners(b.listFeeds())
+	forgotten := 0
+	if forget {
+		forgotten = b.forgetFeedArticles(removed.Name, owners)
+	}
+	pruned := b.history.RemoveFeed(removed.Name, owners)
+	log.Printf("Removed feed %s (%s), dropped %d dedup entries and %d history entries", removed.Name, removed.URL, forgotten, pruned)
+	return nil
+}
+
+// saveRemovedFeeds writes the names of removed feeds to path
+func saveRemovedFeeds(path string, names []string) error {
+	data, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// loadRemovedFeeds reads the feeds removed in earlier runs from path and
+// drops them from the configured set. The set is left alone if nothing
+// would remain
+func (b *Bot) loadRemovedFeeds(path string) error {
+	var names []string
+	if err := loadJSONFile(path, &names); err != nil {
+		return err
+	}
+
+	b.feedsMux.Lock()
+	defer b.feedsMux.Unlock()
+
+	b.removedFeedsPath, b.removedFeeds = path, names
+	removed := make(map[string]bool, len(names))
+	for _, name := range names {
+		removed[name] = true
+	}
+	var feeds []FeedSource
+	for _, feed := range b.feeds {
+		if removed[feed.Name] {
+			log.Printf("Feed %s was removed with /removefeed, skipping it", feed.Name)
+			continue
+		}
+		feeds = append(feeds, feed)
+	}
+	if len(feeds) == 0 {
+		log.Printf("Warning: every configured feed is listed in %s, keeping them all", path)
+		return nil
+	}
+	b.feeds = feeds
+	return nil
+}
+
+// cachedFeedArticles returns the feed's articles, cached under its primary
+// URL, using stale-while-revalidate
+// caching: a fresh entry is returned as is, a stale one (up to feedMaxStale
+// old) is returned immediately while a single background refresh runs, and
+// only a missing or too stale entry makes the caller wait for Habr
+func (b *Bot) cachedFeedArticles(feed FeedSource) ([]Article, error) {
+	b.feedCacheMux.Lock()
+	entry, ok := b.feedCache[feed.URL]
+	if ok {
+		age := b.clock.Now().Sub(entry.fetchedAt)
+		if age <= b.feedCacheTTL {
+			b.feedCacheMux.Unlock()
+			return entry.articles, nil
+		}
+		if age <= b.feedMaxStale {
+			if !entry.refreshing {
+				entry.refreshing = true
+				go b.refreshFeedCache(feed)
+			}
+			b.feedCacheMux.Unlock()
+			return entry.articles, nil
+		}
+	}
+	b.feedCacheMux.Unlock()
+
+	articles, err := b.fetchFeed(feed)
+	if err != nil {
+		return nil, err
+	}
+	b.storeFeedCache(feed.URL, articles)
+	return articles, nil
+}
+
+// refreshFeedCache refetches a feed in the background. On failure the stale
+// entry is kept so it can be retried on the next request
+func (b *Bot) refreshFeedCache(feed FeedSource) {
+	articles, err := b.fetchFeed(feed)
+	if err != nil {
+		log.Printf("Error refreshing cached feed %s: %v", feed.Name, err)
+		b.feedCacheMux.Lock()
+		if entry, ok := b.feedCache[feed.URL]; ok {
+			entry.refreshing = false
+		}
+		b.feedCacheMux.Unlock()
+		return
+	}
+	b.storeFeedCache(feed.URL, articles)
+}
+
+func (b *Bot) storeFeedCache(url string, articles []Article) {
+	b.feedCacheMux.Lock()
+	defer b.feedCacheMux.Unlock()
+
+	b.feedCache[url] = &feedCacheEntry{
+		articles:  articles,
+		fetchedAt: b.clock.Now(),
+	}
+}
+
+// feedFetchAttempts is how many times each feed URL is tried before giving up
+const feedFetchAttempts = 2
+
+// fetchFeed fetches the feed from its primary URL and, if that keeps
+// failing, from its fallback mirror. Articles are attributed to the feed
+// whichever URL served them, and dedup keys come from the items' GUIDs, so
+// switching between the two doesn't resend anything
+func (b *Bot) fetchFeed(feed FeedSource) ([]Article, error) {
+	articles, err := b.fetchFeedWithRetry(feed.URL)
+	if err == nil || feed.FallbackURL == "" {
+		return articles, err
+	}
+
+	log.Printf("Feed %s unavailable at %s (%v), trying fallback %s", feed.Name, feed.URL, err, feed.FallbackURL)
+	articles, fallbackErr := b.fetchFeedWithRetry(feed.FallbackURL)
+	if fallbackErr != nil {
+		return nil, fmt.Errorf("primary: %v; fallback: %w", err, fallbackErr)
+	}
+	log.Printf("Feed %s served from fallback %s", feed.Name, feed.FallbackURL)
+	return articles, nil
+}
+
+// fetchFeedWithRetry tries a feed URL up to feedFetchAttempts times
+func (b *Bot) fetchFeedWithRetry(url string) ([]Article, error) {
+	var err error
+	for attempt := 1; attempt <= feedFetchAttempts; attempt++ {
+		var articles []Article
+		if articles, err = b.fetchFeedArticles(url); err == nil {
+			return articles, nil
+		}
+		if attempt < feedFetchAttempts {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+	return nil, err
+}
+
+// fetchFeedArticles downloads a feed and converts every item into an
+// Article without applying dedup or limits
+func (b *Bot) fetchFeedArticles(url string) ([]Article, error) {
+	start := time.Now()
+	feed, err := b.fp.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	b.lastFetchLatency.Store(int64(time.Since(start)))
+
+	var articles []Article
+	now := b.clock.Now()
+	for _, item := range feed.Items {
+		// Parse publication date
+		pubDate := now
+		if item.PublishedParsed != nil {
+			pubDate = *item.PublishedParsed
+		}
+		// A clock-skewed feed would otherwise keep its items on top forever
+		if pubDate.Sub(now) > b.futureDateTolerance {
+			if b.skipFutureDates {
+				log.Printf("Skipping %q from %s: published %s is in the future", item.Title, url, pubDate.Format(time.RFC3339))
+				continue
+			}
+			log.Printf("Clamping future date %s of %q from %s to now", pubDate.Format(time.RFC3339), item.Title, url)
+			pubDate = now
+		}
+
+		// Create article
+		article := Article{
+			Title:    item.Title,
+			Link:     item.Link,
+			GUID:     item.GUID,
+			Summary:  b.trimSummary(item.Description, b.summaryLength),
+			Content:  item.Description,
+			Severity: classifySeverity(item.Title, item.Description),
+			Date:     pubDate,
+
+			ContentHash: contentHash(item.Title, item.Description),
+		}
+		articles = append(articles, article)
+	}
+
+	return articles, nil
+}
+
+// getHabrInfoSecFeed merges the configured feeds newest first and returns
+// up to 10 articles that /infosec hasn't sent yet. With claim set they are
+// marked as sent; read-only callers such as the API leave them unmarked
+func (b *Bot) getHabrInfoSecFeed(claim bool) ([]Article, error) {
+	var items []Article
+	var lastErr error
+	feeds := b.listFeeds()
+	for _, feed := range feeds {
+		feedArticles, err := b.cachedFeedArticles(feed)
+		if err != nil {
+			// One broken feed shouldn't take the others down
+			log.Printf("Error getting feed %s: %v", feed.Name, err)
+			lastErr = err
+			continue
+		}
+		for _, article := range feedArticles {
+			article.Feed = feed.Name
+			items = append(items, article)
+		}
+	}
+	b.history.Add(items, b.clock.Now())
+	if lastErr != nil && len(items) == 0 {
+		return nil, lastErr
+	}
+	weights := feedWeights(feeds)
+	sortArticles(items, weights)
+
+	// Limit to 10 articles, shared between the feeds by weight
+	articles := selectWeighted(b.claimNewArticles(b.seen, items, 0, true), weights, 10)
+	if !claim {
+		return articles, nil
+	}
+	return b.markClaimed(b.seen, articles), nil
+}
+
+// claimNewArticles filters items down to the ones store hasn't seen yet
+// (plus updated ones when NOTIFY_UPDATES is on) and marks them as sent. A
+// limit of 0 means no limit. With dryRun set nothing is marked
+func (b *Bot) claimNewArticles(store SeenStore, items []Article, limit int, dryRun bool) []Article {
+	var articles []Article
+	for _, article := range items {
+		// Dedup on the computed ID rather than the raw GUID so items
+		// without a GUID don't all collapse into a single empty key
+		key := article.ID()
+
+		// Skip if we've already sent this article, unless it has been
+		// edited since and update notifications are on. This check isn't
+		// what prevents double sends, markClaimed is: it exists so the
+		// limit counts only unsent articles, so dry runs can filter without
+		// marking, and to tell edited articles from new ones
+		if b.wasArticleSent(store, key) {
+			if !b.notifyUpdates || !b.articleUpdateDue(store, key, article.ContentHash) {
+				continue
+			}
+			article.Updated = true
+		}
+
+		articles = append(articles, article)
+
+		if limit > 0 && len(articles) >= limit {
+			break
+		}
+	}
+
+	if !dryRun {
+		articles = b.markClaimed(store, articles)
+	}
+	return articles
+}
+
+// markClaimed records articles from claimNewArticles as sent and returns
+// the ones this call won. Another /infosec or poll cycle may have claimed
+// the same article since it was checked; such articles are dropped so each
+// one is sent only once
+func (b *Bot) markClaimed(store SeenStore, articles []Article) []Article {
+	var claimed []Article
+	for _, article := range articles {
+		var won bool
+		if article.Updated {
+			won = b.markArticleUpdated(store, article.ID(), article.ContentHash)
+		} else {
+			won = b.markArticleIfNew(store, article.ID(), article.Feed, article.ContentHash)
+		}
+		if won {
+			claimed = append(claimed, article)
+		}
+	}
+	return claimed
+}
+
+// sortArticles orders articles newest first. Articles with the same
+// publication time are ordered by the weight of their feed, heaviest first
+func sortArticles(articles []Article, weights map[string]int) {
+	sort.SliceStable(articles, func(i, j int) bool {
+		if !articles[i].Date.Equal(articles[j].Date) {
+			return articles[i].Date.After(articles[j].Date)
+		}
+		return weights[articles[i].Feed] > weights[articles[j].Feed]
+	})
+}
+
+// selectWeighted picks up to limit articles from the sorted candidates,
+// giving each feed a share of the slots proportional to its weight. Slots a
+// feed can't fill are handed to the remaining candidates in order, so equal
+// weights with a single feed behave like a plain top-N. The result keeps
+// the candidates' order
+func selectWeighted(candidates []Article, weights map[string]int, limit int) []Article {
+	total := 0
+	for _, weight := range weights {
+		total += weight
 	}
 
-	articles, err := b.getHabrInfoSecFeed()
-	if err != nil {
-		log.Printf("Error getting Habr feed: %v", err)
-		errorMsg := tgbotapi.NewMessage(chatID, "Ошибка при получении статей. Пожалуйста, попробуйте позже.")
-		b.bot.Send(errorMsg)
-		// If we sent the loading message, try to delete it
-		if sentMsg.MessageID != 0 {
-			deleteMsg := tgbotapi.NewDeleteMessage(chatID, sentMsg.MessageID)
-			b.bot.Send(deleteMsg)
+	picked := make([]bool, len(candidates))
+	taken := make(map[string]int)
+	count := 0
+	for i, article := range candidates {
+		if count >= limit || total == 0 {
+			break
+		}
+		// Round the share up so every feed with weight gets at least one slot
+		share := (limit*weights[article.Feed] + total - 1) / total
+		if taken[article.Feed] < share {
+			picked[i] = true
+			taken[article.Feed]++
+			count++
 		}
-		return
 	}
-
-	if len(articles) == 0 {
-		// If we sent the loading message, try to delete it
-		if sentMsg.MessageID != 0 {
-			deleteMsg := tgbotapi.NewDeleteMessage(chatID, sentMsg.MessageID)
-			b.bot.Send(deleteMsg)
+	for i := range candidates {
+		if count >= limit {
+			break
+		}
+		if !picked[i] {
+			picked[i] = true
+			count++
 		}
-		noArticlesMsg := tgbotapi.NewMessage(chatID, "На данный момент нет новых статей по информационной безопасности.")
-		b.bot.Send(noArticlesMsg)
-		return
 	}
 
-	// Delete the "loading" message if we successfully got articles
-	if sentMsg.MessageID != 0 {
-		deleteMsg := tgbotapi.NewDeleteMessage(chatID, sentMsg.MessageID)
-		b.bot.Send(deleteMsg)
+	var selected []Article
+	for i, article := range candidates {
+		if picked[i] {
+			selected = append(selected, article)
+		}
 	}
+	return selected
+}
 
-	// Send articles
-	for _, article := range articles {
-		articleMsg := tgbotapi.NewMessage(chatID, fmt.Sprintf(
-			"📚 <b>%s</b>\n\n%s\n\n🔗 <a href=\"%s\">Читать на Хабре</a>",
-			html.EscapeString(article.Title),
-			html.EscapeString(article.Summary),
-			article.Link,
-		))
-		articleMsg.ParseMode = "HTML"
-		
-		_, err := b.bot.Send(articleMsg)
+// feedPollResult is the outcome of polling one feed
+type feedPollResult struct {
+	Feed     string
+	URL      string
+	Articles []Article
+	Err      error
+}
+
+// pollOnce runs one poll cycle: every feed is fetched fresh (refreshing the
+// cache), new articles are claimed and, unless dryRun is set, delivered to
+// the push chats newest first. Results are returned per feed
+func (b *Bot) pollOnce(dryRun bool) []feedPollResult {
+	var results []feedPollResult
+	var fresh []Article
+	for _, feed := range b.listFeeds() {
+		result := feedPollResult{Feed: feed.Name, URL: feed.URL}
+		items, err := b.fetchFeed(feed)
 		if err != nil {
-			log.Printf("Error sending article '%s': %v", article.Title, err)
-			// Continue to next article instead of stopping
+			log.Printf("Error polling feed %s: %v", feed.Name, err)
+			result.Err = err
+			results = append(results, result)
 			continue
 		}
-		
-		// Small delay between messages to avoid rate limiting
-		time.Sleep(500 * time.Millisecond)
-	}
-}
+		b.storeFeedCache(feed.URL, items)
 
-func (b *Bot) getHabrInfoSecFeed() ([]Article, error) {
-	// URL for Habr infosec category
-	url := "https://habr.com/ru/rss/hub/infosecurity/all/?fl=ru"
+		tagged := make([]Article, 0, len(items))
+		for _, article := range items {
+			article.Feed = feed.Name
+			tagged = append(tagged, article)
+		}
+		b.history.Add(tagged, b.clock.Now())
+		result.Articles = b.claimNewArticles(b.pushed, tagged, 0, dryRun)
+		fresh = append(fresh, result.Articles...)
+		results = append(results, result)
+	}
 
-	feed, err := b.fp.ParseURL(url)
-	if err != nil {
-		return nil, err
+	if !dryRun {
+		// Runs even without new articles so deferred ones go out
+		sortArticles(fresh, feedWeights(b.listFeeds()))
+		b.deliverToPushChats(fresh)
 	}
+	return results
+}
 
-	var articles []Article
-	for _, item := range feed.Items {
-		// Skip if we've already sent this article
-		if b.wasArticleSent(item.GUID) {
-			continue
+// deliverToPushChats sends new articles to the chats in PUSH_CHAT_IDS and
+// to chats subscribed with /alert, each getting only what it wants. Articles
+// a chat's hourly cap held back earlier go out first, so deferred pushes
+// reach chats where nobody runs /infosec
+func (b *Bot) deliverToPushChats(articles []Article) {
+	if b.sender == nil {
+		if len(articles) > 0 {
+			log.Printf("Web-only mode: not delivering %d new articles", len(articles))
 		}
+		return
+	}
 
-		// Mark as sent
-		b.markArticleAsSent(item.GUID)
-
-		// Parse publication date
-		pubDate := time.Now()
-		if item.PublishedParsed != nil {
-			pubDate = *item.PublishedParsed
+	recipients := make(map[int64]bool)
+	for _, chatID := range b.pushChats() {
+		recipients[chatID] = true
+	}
+	b.settings.Range(func(chatID int64, cs ChatSettings) {
+		if cs.AlertSeverity != "" {
+			recipients[chatID] = true
 		}
+	})
 
-		// Create article
-		article := Article{
-			Title:   item.Title,
-			Link:    item.Link,
-			Summary: b.trimSummary(item.Description),
-			Date:    pubDate,
+	for chatID := range recipients {
+		wanted := b.takeDeferredArticles(chatID)
+		for _, article := range articles {
+			if b.wantsArticle(chatID, article) {
+				wanted = append(wanted, article)
+			}
+		}
+		if len(wanted) > 0 {
+			b.sendArticles(chatID, wanted)
 		}
+	}
+}
 
-		articles = append(articles, article)
+// wantsArticle is the per-chat push decision: a chat with an /alert
+// threshold only gets articles at or above it, other push chats get all
+func (b *Bot) wantsArticle(chatID int64, article Article) bool {
+	threshold, ok := parseSeverity(b.settings.Get(chatID).AlertSeverity)
+	if !ok {
+		return true
+	}
+	return article.Severity >= threshold
+}
 
-		// Limit to 10 most recent articles
-		if len(articles) >= 10 {
-			break
+// runPoller polls the feeds every pollInterval until the process exits.
+// Cycles are skipped while maintenance mode is on
+func (b *Bot) runPoller() {
+	ticker := time.NewTicker(b.pollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if b.maintenance.Load() {
+			continue
 		}
+		b.pollOnce(false)
 	}
-
-	return articles, nil
 }
 
-func (b *Bot) trimSummary(summary string) string {
+func (b *Bot) trimSummary(summary string, maxLen int) string {
+	// Prefer the author's own "read more" cut point when there is one
+	summary = cutAtMarker(summary, b.summaryCutMarkers)
+
 	// Remove HTML tags and trim length
 	summary = strings.ReplaceAll(summary, "<br>", " ")
 	summary = strings.ReplaceAll(summary, "<p>", " ")
@@ -316,14 +2653,35 @@ func (b *Bot) trimSummary(summary string) string {
 	// Remove extra spaces
 	summary = strings.Join(strings.Fields(summary), " ")
 
-	// Limit to 200 characters
-	if len(summary) > 200 {
-		summary = summary[:200] + "..."
+	// Limit the length, also when the text before a cut marker is long.
+	// Count runes so multi-byte characters are never split
+	if runes := []rune(summary); len(runes) > maxLen {
+		summary = string(runes[:maxLen]) + "..."
 	}
 
 	return summary
 }
 
+// cutAtMarker truncates an HTML summary at the earliest of the markers
+// (e.g. "<!-- more -->" or Habr's #habracut link). A marker found inside a tag,
+// such as the href of a "read more" link, cuts off the whole tag
+func cutAtMarker(summary string, markers []string) string {
+	cut := -1
+	for _, marker := range markers {
+		if i := strings.Index(summary, marker); i != -1 && (cut == -1 || i < cut) {
+			cut = i
+		}
+	}
+	if cut == -1 {
+		return summary
+	}
+
+	if open := strings.LastIndex(summary[:cut], "<"); open != -1 && !strings.Contains(summary[open:cut], ">") {
+		cut = open
+	}
+	return summary[:cut]
+}
+
 // API handler for web interface to fetch articles
 func (b *Bot) handleArticlesAPI(w http.ResponseWriter, r *http.Request) {
 	// Set CORS headers
@@ -340,8 +2698,22 @@ func (b *Bot) handleArticlesAPI(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Fetch articles from Habr
-	articles, err := b.getHabrInfoSecFeed()
+	if b.maintenance.Load() {
+		http.Error(w, "Service under maintenance", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Optional extra fields, e.g. ?include=guid
+	includeGUID := false
+	for _, field := range strings.Split(r.URL.Query().Get("include"), ",") {
+		if strings.TrimSpace(field) == "guid" {
+			includeGUID = true
+		}
+	}
+
+	// Fetch articles from Habr. Viewing the API must not use up articles
+	// that /infosec users haven't been sent yet
+	articles, err := b.getHabrInfoSecFeed(false)
 	if err != nil {
 		log.Printf("Error getting articles for API: %v", err)
 		http.Error(w, "Error fetching articles", http.StatusInternalServerError)
@@ -356,6 +2728,10 @@ func (b *Bot) handleArticlesAPI(w http.ResponseWriter, r *http.Request) {
 			"link":    article.Link,
 			"summary": article.Summary,
 		}
+		if includeGUID {
+			articleMap["guid"] = article.GUID
+			articleMap["id"] = article.ID()
+		}
 		response = append(response, articleMap)
 	}
 
@@ -371,8 +2747,470 @@ func (b *Bot) handleArticlesAPI(w http.ResponseWriter, r *http.Request) {
 	w.Write(jsonData)
 }
 
+// historyResponseEntry is an article as returned by /api/history. Archived
+// entries come without a summary
+type historyResponseEntry struct {
+	ID       string    `json:"id"`
+	Title    string    `json:"title"`
+	Link     string    `json:"link"`
+	Feed     string    `json:"feed"`
+	Summary  string    `json:"summary,omitempty"`
+	Date     time.Time `json:"date"`
+	SeenAt   time.Time `json:"seen_at"`
+	Archived bool      `json:"archived"`
+}
+
+// handleHistoryAPI returns the article history, newest first
+func (b *Bot) handleHistoryAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if b.maintenance.Load() {
+		http.Error(w, "Service under maintenance", http.StatusServiceUnavailable)
+		return
+	}
+
+	response := []historyResponseEntry{}
+	for _, entry := range b.history.Entries() {
+		response = append(response, historyResponseEntry{
+			ID:       entry.ID(),
+			Title:    entry.Title,
+			Link:     entry.Link,
+			Feed:     entry.Feed,
+			Summary:  entry.Summary,
+			Date:     entry.Date,
+			SeenAt:   entry.SeenAt,
+			Archived: entry.Archived,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding history response: %v", err)
+	}
+}
+
+// pollResponseArticle is an article as returned by /api/admin/poll
+type pollResponseArticle struct {
+	ID      string    `json:"id"`
+	GUID    string    `json:"guid"`
+	Title   string    `json:"title"`
+	Link    string    `json:"link"`
+	Summary string    `json:"summary"`
+	Date    time.Time `json:"date"`
+	Updated bool      `json:"updated,omitempty"`
+}
+
+// pollResponseFeed is one feed's result in the /api/admin/poll response
+type pollResponseFeed struct {
+	Feed     string                `json:"feed"`
+	URL      string                `json:"url"`
+	Error    string                `json:"error,omitempty"`
+	Articles []pollResponseArticle `json:"articles"`
+}
+
+// handleAdminPollAPI runs one poll cycle synchronously and returns the newly
+// discovered articles per feed. With ?dry_run=1 nothing is marked as sent
+// or delivered, otherwise the articles go out to the push chats as usual
+func (b *Bot) handleAdminPollAPI(w http.ResponseWriter, r *http.Request) {
+	if !b.checkAdminAPIKey(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if b.maintenance.Load() {
+		http.Error(w, "Service under maintenance", http.StatusServiceUnavailable)
+		return
+	}
+
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+
+	var feeds []pollResponseFeed
+	for _, result := range b.pollOnce(dryRun) {
+		feed := pollResponseFeed{Feed: result.Feed, URL: result.URL, Articles: []pollResponseArticle{}}
+		if result.Err != nil {
+			feed.Error = result.Err.Error()
+		}
+		for _, article := range result.Articles {
+			feed.Articles = append(feed.Articles, pollResponseArticle{
+				ID:      article.ID(),
+				GUID:    article.GUID,
+				Title:   article.Title,
+				Link:    article.Link,
+				Summary: article.Summary,
+				Date:    article.Date,
+				Updated: article.Updated,
+			})
+		}
+		feeds = append(feeds, feed)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"dry_run": dryRun,
+		"feeds":   feeds,
+	})
+}
+
+// checkAdminAPIKey reports whether the request carries the admin API key as
+// a bearer token. Without a configured key every request is rejected
+func (b *Bot) checkAdminAPIKey(r *http.Request) bool {
+	if b.adminAPIKey == "" {
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(b.adminAPIKey)) == 1
+}
+
+// handleHealthz reports liveness and readiness. The process stays live in
+// maintenance mode but isn't ready to serve users. It always answers 200, so
+// a liveness probe pointed here doesn't restart the bot; /readyz is the
+// probe that fails in maintenance
+func (b *Bot) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	maintenance := b.maintenance.Load()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{
+		"live":        true,
+		"ready":       !maintenance,
+		"maintenance": maintenance,
+	})
+}
+
+// handleLivez answers 200 as long as the process serves HTTP
+func (b *Bot) handleLivez(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz answers 503 in maintenance mode so traffic is routed away
+func (b *Bot) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if b.maintenance.Load() {
+		http.Error(w, "maintenance", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// latencyBuckets are the histogram upper bounds in seconds
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// latencyHistogram is a minimal Prometheus-style histogram with a single label
+type latencyHistogram struct {
+	mu     sync.Mutex
+	series map[string]*latencySeries
+}
+
+type latencySeries struct {
+	buckets []uint64 // cumulative counts per latencyBuckets entry
+	count   uint64
+	sum     float64
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{series: make(map[string]*latencySeries)}
+}
+
+// Observe records one duration under the label value
+func (h *latencyHistogram) Observe(label string, d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[label]
+	if !ok {
+		s = &latencySeries{buckets: make([]uint64, len(latencyBuckets))}
+		h.series[label] = s
+	}
+
+	seconds := d.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.sum += seconds
+}
+
+// WritePrometheus writes the histogram in the Prometheus text exposition format
+func (h *latencyHistogram) WritePrometheus(w io.Writer, name, help, labelName string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	labels := make([]string, 0, len(h.series))
+	for label := range h.series {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for _, label := range labels {
+		s := h.series[label]
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"%g\"} %d\n", name, labelName, label, bound, s.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", name, labelName, label, s.count)
+		fmt.Fprintf(w, "%s_sum{%s=%q} %g\n", name, labelName, label, s.sum)
+		fmt.Fprintf(w, "%s_count{%s=%q} %d\n", name, labelName, label, s.count)
+	}
+}
+
+// handleMetrics exposes the bot's metrics in the Prometheus text format
+func (b *Bot) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	b.sendLatency.WritePrometheus(w, "telegram_send_duration_seconds", "Duration of Telegram send calls by message type.", "type")
+}
+
+// configureFromEnv overrides the bot defaults with settings from the
+// environment. Invalid values are fatal so misconfiguration is caught at startup
+func (b *Bot) configureFromEnv() {
+	// Per-chat hourly cap on pushed articles
+	b.chatHourlyCap = envInt("CHAT_HOURLY_CAP", b.chatHourlyCap)
+	// Comma-separated Telegram user IDs allowed to run admin commands
+	for _, id := range envIDList("ADMIN_USER_IDS") {
+		b.adminIDs[id] = true
+	}
+
+	// Chats that receive new articles from the background poller
+	b.pushChatIDs = envIDList("PUSH_CHAT_IDS")
+	b.pollInterval = envDuration("POLL_INTERVAL", b.pollInterval)
+	b.adminAPIKey = readSecret("ADMIN_API_KEY")
+
+	// Start paused, e.g. during planned upstream maintenance
+	switch v := os.Getenv("MAINTENANCE_MODE"); v {
+	case "", "off":
+	case "on":
+		b.maintenance.Store(true)
+	default:
+		log.Fatalf("Invalid MAINTENANCE_MODE %q: expected on or off", v)
+	}
+
+	// Feed set as comma-separated name=url or name:weight=url pairs, where
+	// url may be followed by |fallback_url. Defaults to the infosec hub
+	if v := os.Getenv("FEEDS"); v != "" {
+		var feeds []FeedSource
+		for _, pair := range strings.Split(v, ",") {
+			name, url, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || name == "" || url == "" {
+				log.Fatalf("Invalid FEEDS entry %q: expected name=url", pair)
+			}
+			url, fallbackURL, _ := strings.Cut(url, "|")
+			weight := 1
+			if n, w, ok := strings.Cut(name, ":"); ok {
+				var err error
+				if weight, err = strconv.Atoi(w); err != nil || weight < 1 {
+					log.Fatalf("Invalid FEEDS weight in %q: expected a positive number", pair)
+				}
+				name = n
+			}
+			feeds = append(feeds, FeedSource{Name: name, URL: url, Weight: weight, FallbackURL: fallbackURL})
+		}
+		b.feeds = feeds
+	}
+
+	// Persist dedup state across restarts; pushes are tracked in a sibling file
+	if path := os.Getenv("SEEN_STORE_PATH"); path != "" {
+		store, err := newFileSeenStore(path)
+		if err != nil {
+			log.Fatalf("Error opening seen store: %v", err)
+		}
+		b.seen = store
+		pushed, err := newFileSeenStore(path + ".push")
+		if err != nil {
+			log.Fatalf("Error opening push seen store: %v", err)
+		}
+		b.pushed = pushed
+		// Feeds removed with /removefeed stay removed
+		if err := b.loadRemovedFeeds(path + ".removed"); err != nil {
+			log.Fatalf("Error loading removed feeds: %v", err)
+		}
+	}
+	switch v := os.Getenv("NOTIFY_UPDATES"); v {
+	case "", "off":
+	case "on":
+		b.notifyUpdates = true
+	default:
+		log.Fatalf("Invalid NOTIFY_UPDATES %q: expected on or off", v)
+	}
+	b.renotifyInterval = envDuration("UPDATE_RENOTIFY_INTERVAL", b.renotifyInterval)
+
+	// Per-chat settings such as /summarylen survive restarts when a path is set
+	if path := os.Getenv("SETTINGS_PATH"); path != "" {
+		store, err := openSettingsStore(path)
+		if err != nil {
+			log.Fatalf("Error opening settings store: %v", err)
+		}
+		b.settings = store
+	}
+	// Article history for roundups
+	if path := os.Getenv("HISTORY_PATH"); path != "" {
+		store, err := openHistoryStore(path)
+		if err != nil {
+			log.Fatalf("Error opening article history: %v", err)
+		}
+		b.history = store
+	}
+	b.historyRetention = envDuration("HISTORY_RETENTION", b.historyRetention)
+	b.historyArchiveAfter = envDuration("HISTORY_ARCHIVE_AFTER", b.historyArchiveAfter)
+	if b.historyArchiveAfter > 0 && b.historyArchiveAfter >= b.historyRetention {
+		log.Fatalf("Invalid HISTORY_ARCHIVE_AFTER %s: must be shorter than HISTORY_RETENTION %s", b.historyArchiveAfter, b.historyRetention)
+	}
+
+	b.summaryLength = envInt("SUMMARY_LENGTH", b.summaryLength)
+	if b.summaryLength < minSummaryLength || b.summaryLength > maxSummaryLength {
+		log.Fatalf("Invalid SUMMARY_LENGTH %d: expected %d to %d", b.summaryLength, minSummaryLength, maxSummaryLength)
+	}
+
+	switch v := os.Getenv("SUMMARY_BLOCKQUOTE"); v {
+	case "", "off":
+	case "on":
+		b.summaryBlockquote = true
+	default:
+		log.Fatalf("Invalid SUMMARY_BLOCKQUOTE %q: expected on or off", v)
+	}
+
+	// Comma-separated "read more" markers for summaries, "none" disables them
+	if v := os.Getenv("SUMMARY_CUT_MARKERS"); v == "none" {
+		b.summaryCutMarkers = nil
+	} else if v != "" {
+		b.summaryCutMarkers = nil
+		for _, marker := range strings.Split(v, ",") {
+			if marker = strings.TrimSpace(marker); marker != "" {
+				b.summaryCutMarkers = append(b.summaryCutMarkers, marker)
+			}
+		}
+	}
+
+	// Feed cache freshness; FEED_CACHE_TTL=0 with FEED_MAX_STALE=0 disables caching
+	b.feedCacheTTL = envDuration("FEED_CACHE_TTL", b.feedCacheTTL)
+	b.feedMaxStale = envDuration("FEED_MAX_STALE", b.feedMaxStale)
+	if b.feedMaxStale < b.feedCacheTTL {
+		b.feedMaxStale = b.feedCacheTTL
+	}
+
+	// Articles dated further ahead than the tolerance are clamped to now or skipped
+	b.futureDateTolerance = envDuration("FUTURE_DATE_TOLERANCE", b.futureDateTolerance)
+	switch v := os.Getenv("FUTURE_DATES"); v {
+	case "", "clamp":
+	case "skip":
+		b.skipFutureDates = true
+	default:
+		log.Fatalf("Invalid FUTURE_DATES %q: expected clamp or skip", v)
+	}
+
+	switch v := os.Getenv("CHAT_OVERFLOW"); v {
+	case "":
+	case "defer":
+		b.deferOverflow = true
+	case "drop":
+		b.deferOverflow = false
+	default:
+		log.Fatalf("Invalid CHAT_OVERFLOW %q: expected defer or drop", v)
+	}
+}
+
+// readSecret returns the value of the named secret. If NAME_FILE is set the
+// secret is read from that file (Docker/Kubernetes secrets style), which
+// keeps it out of the process environment; otherwise NAME itself is used
+func readSecret(name string) string {
+	if path := os.Getenv(name + "_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("Error reading %s_FILE: %v", name, err)
+		}
+		return strings.TrimRight(string(data), " \t\r\n")
+	}
+	return os.Getenv(name)
+}
+
+// envDuration reads a non-negative duration such as "5m" from the
+// environment, returning def when the variable is unset
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Fatalf("Invalid %s %q: expected a duration such as 5m", name, v)
+	}
+	return d
+}
+
+// envIDList reads a comma-separated list of Telegram IDs from the environment
+func envIDList(name string) []int64 {
+	var ids []int64
+	for _, field := range strings.Split(os.Getenv(name), ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			log.Fatalf("Invalid %s entry %q: %v", name, field, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// envInt reads a non-negative integer from the environment, returning def
+// when the variable is unset
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Fatalf("Invalid %s %q: expected a non-negative number", name, v)
+	}
+	return n
+}
+
+// registerPublicRoutes mounts the endpoints meant for everyone: the web
+// interface and the articles feed it reads from
+func (b *Bot) registerPublicRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/api/articles", b.handleArticlesAPI)
+	mux.HandleFunc("/api/history", b.handleHistoryAPI)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		// Serve static files from docs directory
+		http.FileServer(http.Dir("./docs")).ServeHTTP(w, r)
+	})
+}
+
+// registerHealthRoutes mounts the health probes. They reveal nothing but
+// whether the bot is up, so they are served on the public listener too
+func (b *Bot) registerHealthRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", b.handleHealthz)
+	mux.HandleFunc("/livez", b.handleLivez)
+	mux.HandleFunc("/readyz", b.handleReadyz)
+}
+
+// registerAdminRoutes mounts the endpoints meant for operators only.
+// When ADMIN_ADDR is set they are served on a separate listener that
+// should be bound to localhost or a private network
+func (b *Bot) registerAdminRoutes(mux *http.ServeMux) {
+	b.registerHealthRoutes(mux)
+	mux.HandleFunc("/api/admin/poll", b.handleAdminPollAPI)
+	mux.HandleFunc("/metrics", b.handleMetrics)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
 func main() {
-	token := os.Getenv("TELEGRAM_BOT_TOKEN")
+	token := readSecret("TELEGRAM_BOT_TOKEN")
 	
 	var bot *Bot
 	if token != "" && token != "dummy_token_for_testing" {
@@ -383,24 +3221,79 @@ func main() {
 		// Create a bot instance without connecting to Telegram API
 		bot = NewBotWithoutTelegram()
 	}
-	
-	// Set up HTTP handlers for web interface
-	http.HandleFunc("/api/articles", bot.handleArticlesAPI)
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		// Serve static files from docs directory
-		http.FileServer(http.Dir("./docs")).ServeHTTP(w, r)
-	})
 
-	// Start the web server
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080" // Default port
 	}
+	// Optional separate listener for admin/debug endpoints
+	adminAddr := os.Getenv("ADMIN_ADDR")
+	// Without ADMIN_ADDR the admin endpoints are only served on PORT on request
+	adminOnPublic := false
+	switch v := os.Getenv("ADMIN_ON_PUBLIC_PORT"); v {
+	case "", "off":
+	case "on":
+		adminOnPublic = true
+	default:
+		log.Fatalf("Invalid ADMIN_ON_PUBLIC_PORT %q: expected on or off", v)
+	}
+
+	bot.configureFromEnv()
+
+	// Set up HTTP handlers for web interface
+	publicMux := http.NewServeMux()
+	bot.registerPublicRoutes(publicMux)
+
+	servers := []*http.Server{{Addr: ":" + port, Handler: publicMux}}
+	if adminAddr != "" {
+		adminMux := http.NewServeMux()
+		bot.registerAdminRoutes(adminMux)
+		servers = append(servers, &http.Server{Addr: adminAddr, Handler: adminMux})
+		bot.registerHealthRoutes(publicMux)
+	} else if adminOnPublic {
+		// Single listener mode, explicitly asked for: everything on PORT
+		bot.registerAdminRoutes(publicMux)
+	} else {
+		// pprof, metrics and the admin API stay off the public listener
+		bot.registerHealthRoutes(publicMux)
+	}
+
+	go bot.Start()
+
 	log.Printf("Starting web server on port %s", port)
 	log.Printf("Web interface available at http://localhost:%s", port)
 	log.Printf("API available at http://localhost:%s/api/articles", port)
-	
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Printf("Web server error: %v", err)
+	if adminAddr != "" {
+		log.Printf("Admin endpoints available at http://%s", adminAddr)
+	} else if !adminOnPublic {
+		log.Printf("Admin endpoints disabled: set ADMIN_ADDR or ADMIN_ON_PUBLIC_PORT=on to serve them")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("Web server error on %s: %v", srv.Addr, err)
+				stop()
+			}
+		}(srv)
+	}
+
+	<-ctx.Done()
+	log.Println("Shutting down web servers...")
+
+	// Give in-flight requests a chance to finish
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Error shutting down server on %s: %v", srv.Addr, err)
+		}
 	}
+	wg.Wait()
 }
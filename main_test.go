@@ -0,0 +1,1427 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"golang.org/x/time/rate"
+)
+
+// fakeClock is a Clock that only moves when told to
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// sentMessage is a text message captured by fakeSender
+type sentMessage struct {
+	ChatID int64
+	Text   string
+}
+
+// fakeSender records text messages instead of sending them. When fail is
+// set, it is consulted first and a non-nil error fails the send
+type fakeSender struct {
+	mu   sync.Mutex
+	sent []sentMessage
+	fail func(msg tgbotapi.MessageConfig) error
+}
+
+func (s *fakeSender) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg, ok := c.(tgbotapi.MessageConfig)
+	if !ok {
+		return tgbotapi.Message{}, nil
+	}
+	if s.fail != nil {
+		if err := s.fail(msg); err != nil {
+			return tgbotapi.Message{}, err
+		}
+	}
+	s.sent = append(s.sent, sentMessage{ChatID: msg.ChatID, Text: msg.Text})
+	return tgbotapi.Message{MessageID: len(s.sent)}, nil
+}
+
+// messages returns the messages sent to chatID
+func (s *fakeSender) messages(chatID int64) []sentMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []sentMessage
+	for _, msg := range s.sent {
+		if msg.ChatID == chatID {
+			out = append(out, msg)
+		}
+	}
+	return out
+}
+
+// countContaining returns how many messages to chatID contain substr
+func (s *fakeSender) countContaining(chatID int64, substr string) int {
+	n := 0
+	for _, msg := range s.messages(chatID) {
+		if strings.Contains(msg.Text, substr) {
+			n++
+		}
+	}
+	return n
+}
+
+// testItem is an item served by a test RSS feed
+type testItem struct {
+	Title       string
+	Link        string
+	GUID        string
+	Description string
+	Date        time.Time
+}
+
+// rssFeed renders items as an RSS 2.0 document
+func rssFeed(items ...testItem) string {
+	var sb strings.Builder
+	sb.WriteString(`<?xml version="1.0" encoding="UTF-8"?><rss version="2.0"><channel><title>test</title>`)
+	for _, item := range items {
+		sb.WriteString("<item>")
+		fmt.Fprintf(&sb, "<title>%s</title><link>%s</link>", html.EscapeString(item.Title), html.EscapeString(item.Link))
+		if item.GUID != "" {
+			fmt.Fprintf(&sb, "<guid>%s</guid>", html.EscapeString(item.GUID))
+		}
+		fmt.Fprintf(&sb, "<description>%s</description>", html.EscapeString(item.Description))
+		if !item.Date.IsZero() {
+			fmt.Fprintf(&sb, "<pubDate>%s</pubDate>", item.Date.UTC().Format(time.RFC1123Z))
+		}
+		sb.WriteString("</item>")
+	}
+	sb.WriteString("</channel></rss>")
+	return sb.String()
+}
+
+// newFeedServer serves the items as an RSS feed
+func newFeedServer(t *testing.T, items ...testItem) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, rssFeed(items...))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newTestBot returns a web-only bot reading the given feeds, without rate
+// limiting or feed caching
+func newTestBot(feeds ...FeedSource) *Bot {
+	b := NewBotWithoutTelegram()
+	b.limiter = rate.NewLimiter(rate.Inf, 1)
+	b.feedCacheTTL = 0
+	b.feedMaxStale = 0
+	b.sendInterval = 0
+	if len(feeds) > 0 {
+		b.feeds = feeds
+	}
+	return b
+}
+
+func TestArticlesAPIIncludesGUID(t *testing.T) {
+	srv := newFeedServer(t, testItem{Title: "Первая", Link: "https://habr.com/ru/articles/1/", GUID: "habr-1", Description: "text"})
+	b := newTestBot(FeedSource{Name: "infosec", URL: srv.URL, Weight: 1})
+
+	rec := httptest.NewRecorder()
+	b.handleArticlesAPI(rec, httptest.NewRequest("GET", "/api/articles?include=guid", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %q", rec.Code, rec.Body)
+	}
+
+	var got []map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("got %d articles, want 1", len(got))
+	}
+	if got[0]["guid"] != "habr-1" {
+		t.Errorf("guid = %q, want habr-1", got[0]["guid"])
+	}
+	if want := (Article{GUID: "habr-1"}).ID(); got[0]["id"] != want {
+		t.Errorf("id = %q, want %q", got[0]["id"], want)
+	}
+}
+
+func TestArticlesAPIOmitsGUIDByDefault(t *testing.T) {
+	srv := newFeedServer(t, testItem{Title: "Первая", Link: "https://habr.com/ru/articles/1/", GUID: "habr-1"})
+	b := newTestBot(FeedSource{Name: "infosec", URL: srv.URL, Weight: 1})
+
+	rec := httptest.NewRecorder()
+	b.handleArticlesAPI(rec, httptest.NewRequest("GET", "/api/articles", nil))
+
+	var got []map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("got %d articles, want 1", len(got))
+	}
+	if _, ok := got[0]["guid"]; ok {
+		t.Errorf("guid included without ?include=guid: %v", got[0])
+	}
+}
+
+// testArticles returns n distinct articles from the given feed
+func testArticles(feed string, n int) []Article {
+	articles := make([]Article, n)
+	for i := range articles {
+		articles[i] = Article{
+			Title: fmt.Sprintf("%s %d", feed, i),
+			Link:  fmt.Sprintf("https://habr.com/ru/articles/%s-%d/", feed, i),
+			GUID:  fmt.Sprintf("%s-%d", feed, i),
+			Feed:  feed,
+		}
+	}
+	return articles
+}
+
+// withSender gives the bot a fake sender and clock and returns them
+func withSender(b *Bot) (*fakeSender, *fakeClock) {
+	sender, clock := &fakeSender{}, newFakeClock()
+	b.sender, b.clock = sender, clock
+	return sender, clock
+}
+
+func TestHourlyCapDefersOverflow(t *testing.T) {
+	b := newTestBot()
+	sender, clock := withSender(b)
+	b.chatHourlyCap, b.deferOverflow = 2, true
+	b.pushChatIDs = []int64{42}
+
+	b.sendArticles(42, testArticles("infosec", 5))
+	if n := sender.countContaining(42, "infosec "); n != 2 {
+		t.Fatalf("sent %d articles, want 2", n)
+	}
+	if n := sender.countContaining(42, "Достигнут лимит"); n != 1 {
+		t.Fatalf("sent %d overflow notices, want 1", n)
+	}
+	if n := len(b.deferredArticles[42]); n != 3 {
+		t.Fatalf("deferred %d articles, want 3", n)
+	}
+
+	// Another capped cycle within the hour queues more but stays quiet
+	b.deliverToPushChats(testArticles("go", 1))
+	if n := sender.countContaining(42, "Достигнут лимит"); n != 1 {
+		t.Errorf("sent %d overflow notices within the hour, want 1", n)
+	}
+	if n := len(b.deferredArticles[42]); n != 4 {
+		t.Fatalf("deferred %d articles, want 4", n)
+	}
+
+	// Once the window has passed the next push cycle drains the queue
+	// without anyone running /infosec
+	clock.Advance(time.Hour + time.Second)
+	b.deliverToPushChats(nil)
+	if n := sender.countContaining(42, "infosec ") + sender.countContaining(42, "go "); n != 4 {
+		t.Errorf("sent %d articles after the window, want 4", n)
+	}
+	if n := len(b.deferredArticles[42]); n != 2 {
+		t.Errorf("%d articles still deferred, want 2", n)
+	}
+}
+
+func TestHourlyCapDropsOverflow(t *testing.T) {
+	b := newTestBot()
+	sender, _ := withSender(b)
+	b.chatHourlyCap, b.deferOverflow = 2, false
+
+	b.sendArticles(42, testArticles("infosec", 5))
+	if n := sender.countContaining(42, "infosec "); n != 2 {
+		t.Fatalf("sent %d articles, want 2", n)
+	}
+	if n := sender.countContaining(42, "Пропущено статей: 3"); n != 1 {
+		t.Errorf("sent %d drop notices, want 1", n)
+	}
+	if n := len(b.deferredArticles[42]); n != 0 {
+		t.Errorf("deferred %d articles in drop mode, want 0", n)
+	}
+}
+
+func TestHourlyCapIsPerChat(t *testing.T) {
+	b := newTestBot()
+	sender, _ := withSender(b)
+	b.chatHourlyCap = 2
+
+	b.sendArticles(1, testArticles("infosec", 2))
+	b.sendArticles(2, testArticles("infosec", 2))
+	if n := sender.countContaining(2, "infosec "); n != 2 {
+		t.Errorf("second chat got %d articles, want 2", n)
+	}
+	if n := sender.countContaining(2, "Достигнут лимит"); n != 0 {
+		t.Errorf("second chat got %d overflow notices, want 0", n)
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		text    string
+		command string
+		mention string
+		args    []string
+	}{
+		{"/infosec", "/infosec", "", nil},
+		{"/InfoSec@Go", "/infosec", "go", nil},
+		{"/infosec topic:python", "/infosec", "", []string{"topic:python"}},
+		{"/infosec@HabrSecBot", "/infosec", "", nil},
+		{"/infosec@habrsecbot topic:go", "/infosec", "", []string{"topic:go"}},
+		{"hello /infosec", "", "", nil},
+		{"", "", "", nil},
+	}
+	for _, tt := range tests {
+		command, mention, args := parseCommand(tt.text, "HabrSecBot")
+		if command != tt.command || mention != tt.mention || strings.Join(args, " ") != strings.Join(tt.args, " ") {
+			t.Errorf("parseCommand(%q) = %q, %q, %q; want %q, %q, %q", tt.text, command, mention, args, tt.command, tt.mention, tt.args)
+		}
+	}
+}
+
+func TestHubFromArgs(t *testing.T) {
+	tests := []struct {
+		mention string
+		args    []string
+		hub     string
+		ok      bool
+	}{
+		{"", nil, "", true},
+		{"go", nil, "go", true},
+		{"", []string{"topic:Python"}, "python", true},
+		{"go", []string{"topic:linux"}, "linux", true},
+		{"", []string{"topic:nosuchhub"}, "nosuchhub", false},
+		{"nosuchhub", nil, "nosuchhub", false},
+	}
+	for _, tt := range tests {
+		hub, ok := hubFromArgs(tt.mention, tt.args)
+		if hub != tt.hub || ok != tt.ok {
+			t.Errorf("hubFromArgs(%q, %q) = %q, %v; want %q, %v", tt.mention, tt.args, hub, ok, tt.hub, tt.ok)
+		}
+	}
+}
+
+func TestHubPeekBypassesHourlyCap(t *testing.T) {
+	b := newTestBot()
+	sender, _ := withSender(b)
+	b.chatHourlyCap, b.deferOverflow = 1, true
+	b.feedCacheTTL = time.Hour
+	b.storeFeedCache(fmt.Sprintf(habrHubFeedURL, "go"), testArticles("go", 3))
+
+	b.sendHubPeek(42, "go")
+	if n := sender.countContaining(42, "go "); n != 3 {
+		t.Fatalf("sent %d peeked articles, want 3", n)
+	}
+	if n := sender.countContaining(42, "Достигнут лимит"); n != 0 {
+		t.Errorf("peek sent %d overflow notices", n)
+	}
+	if len(b.deferredArticles[42]) != 0 || len(b.chatSends[42]) != 0 {
+		t.Errorf("peek changed the chat's cap state: deferred %d, sends %d", len(b.deferredArticles[42]), len(b.chatSends[42]))
+	}
+}
+
+func TestHealthProbesInMaintenance(t *testing.T) {
+	b := newTestBot()
+	mux := http.NewServeMux()
+	b.registerHealthRoutes(mux)
+	serve := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+
+	probe := func(path string) int {
+		return serve(path).Code
+	}
+
+	for _, path := range []string{"/healthz", "/livez", "/readyz"} {
+		if code := probe(path); code != http.StatusOK {
+			t.Errorf("%s = %d before maintenance, want 200", path, code)
+		}
+	}
+
+	b.maintenance.Store(true)
+	want := map[string]int{
+		"/healthz": http.StatusOK,
+		"/livez":   http.StatusOK,
+		"/readyz":  http.StatusServiceUnavailable,
+	}
+	for path, code := range want {
+		if got := probe(path); got != code {
+			t.Errorf("%s = %d in maintenance, want %d", path, got, code)
+		}
+	}
+
+	var health map[string]bool
+	if err := json.Unmarshal(serve("/healthz").Body.Bytes(), &health); err != nil {
+		t.Fatal(err)
+	}
+	if !health["live"] || health["ready"] || !health["maintenance"] {
+		t.Errorf("/healthz in maintenance = %v, want live but not ready", health)
+	}
+}
+
+func TestArticleExpiryWithFakeClock(t *testing.T) {
+	b := newTestBot()
+	clock := newFakeClock()
+	b.clock = clock
+	b.articleExpiry = 24 * time.Hour
+
+	if !b.markArticleIfNew(b.seen, "a", "infosec", "") {
+		t.Fatal("first mark of a new article failed")
+	}
+
+	clock.Advance(b.articleExpiry)
+	if !b.wasArticleSent(b.seen, "a") {
+		t.Error("article forgotten exactly at articleExpiry")
+	}
+	if b.markArticleIfNew(b.seen, "a", "infosec", "") {
+		t.Error("article re-marked exactly at articleExpiry")
+	}
+	b.cleanupExpiredArticles()
+	if b.seen.Len() != 1 {
+		t.Error("cleanup removed an article exactly at articleExpiry")
+	}
+
+	clock.Advance(time.Nanosecond)
+	if b.wasArticleSent(b.seen, "a") {
+		t.Error("article still sent just past articleExpiry")
+	}
+}
+
+func TestMarkIfNewReplacesExpiredEntry(t *testing.T) {
+	b := newTestBot()
+	clock := newFakeClock()
+	b.clock = clock
+	b.articleExpiry = time.Hour
+
+	b.markArticleIfNew(b.seen, "a", "infosec", "")
+	clock.Advance(time.Hour + time.Nanosecond)
+	if !b.markArticleIfNew(b.seen, "a", "infosec", "") {
+		t.Fatal("expired article couldn't be marked again")
+	}
+	if entry, _ := b.seen.Get("a"); !entry.SentAt.Equal(clock.Now()) {
+		t.Errorf("SentAt = %v, want %v", entry.SentAt, clock.Now())
+	}
+}
+
+func TestCleanupExpiredArticles(t *testing.T) {
+	b := newTestBot()
+	clock := newFakeClock()
+	b.clock = clock
+	b.articleExpiry = time.Hour
+
+	b.markArticleIfNew(b.seen, "old", "infosec", "")
+	clock.Advance(30 * time.Minute)
+	b.markArticleIfNew(b.seen, "new", "infosec", "")
+	clock.Advance(30*time.Minute + time.Nanosecond)
+
+	b.cleanupExpiredArticles()
+	if _, ok := b.seen.Get("old"); ok {
+		t.Error("expired article kept by cleanup")
+	}
+	if _, ok := b.seen.Get("new"); !ok {
+		t.Error("unexpired article removed by cleanup")
+	}
+}
+
+func TestFitArticleMessageWithinLimit(t *testing.T) {
+	long := strings.Repeat("я", 2*telegramMaxMessageLength)
+	link := "https://habr.com/ru/articles/1/"
+	tests := []struct {
+		name     string
+		article  Article
+		wantLink bool
+	}{
+		{"short", Article{Title: "Заголовок", Summary: "Описание", Link: link}, true},
+		{"long summary", Article{Title: "Заголовок", Summary: long, Link: link}, true},
+		{"long title", Article{Title: long, Summary: long, Link: link}, true},
+		{"escaped summary", Article{Title: "t", Summary: strings.Repeat("<&>", telegramMaxMessageLength), Link: link}, true},
+		{"long link", Article{Link: link + "?q=" + long}, false},
+	}
+	for _, tt := range tests {
+		for _, blockquote := range []bool{false, true} {
+			text := fitArticleMessage(tt.article, blockquote)
+			if n := utf8.RuneCountInString(text); n > telegramMaxMessageLength {
+				t.Errorf("%s (blockquote %v): %d characters, limit %d", tt.name, blockquote, n, telegramMaxMessageLength)
+			}
+			if got := strings.Contains(text, "<a href="); got != tt.wantLink {
+				t.Errorf("%s (blockquote %v): link present = %v, want %v", tt.name, blockquote, got, tt.wantLink)
+			}
+		}
+	}
+}
+
+func TestFitArticleMessageKeepsShortMessages(t *testing.T) {
+	article := Article{Title: "Заголовок", Summary: "Описание", Link: "https://habr.com/ru/articles/1/"}
+	if got, want := fitArticleMessage(article, false), formatArticleMessage(article.Title, article.Summary, article.Link, false); got != want {
+		t.Errorf("short message changed:\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestFeedCacheStaleWhileRevalidate(t *testing.T) {
+	var hits atomic.Int32
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		started <- struct{}{}
+		<-release
+		fmt.Fprint(w, rssFeed(testItem{Title: "fresh", Link: "https://habr.com/ru/articles/2/", GUID: "fresh"}))
+	}))
+	t.Cleanup(srv.Close)
+
+	feed := FeedSource{Name: "infosec", URL: srv.URL, Weight: 1}
+	b := newTestBot(feed)
+	clock := newFakeClock()
+	b.clock = clock
+	b.feedCacheTTL, b.feedMaxStale = time.Minute, time.Hour
+	b.storeFeedCache(feed.URL, testArticles("cached", 1))
+
+	// Stale: every caller gets the cached copy at once, one refresh runs
+	clock.Advance(2 * time.Minute)
+	for i := 0; i < 3; i++ {
+		articles, err := b.cachedFeedArticles(feed)
+		if err != nil || len(articles) != 1 || articles[0].GUID != "cached-0" {
+			t.Fatalf("stale hit %d = %v, %v; want the cached article", i, articles, err)
+		}
+	}
+	<-started
+	if n := hits.Load(); n != 1 {
+		t.Fatalf("%d background refreshes started, want 1", n)
+	}
+	close(release)
+	waitFor(t, func() bool {
+		b.feedCacheMux.Lock()
+		defer b.feedCacheMux.Unlock()
+		return b.feedCache[feed.URL].articles[0].GUID == "fresh"
+	})
+
+	// Too stale: the caller waits for the fetch
+	clock.Advance(2 * time.Hour)
+	b.storeFeedCache(feed.URL, testArticles("cached", 1))
+	clock.Advance(2 * time.Hour)
+	articles, err := b.cachedFeedArticles(feed)
+	if err != nil || len(articles) != 1 || articles[0].GUID != "fresh" {
+		t.Fatalf("entry past feedMaxStale = %v, %v; want a fresh fetch", articles, err)
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("%d fetches, want 2", n)
+	}
+}
+
+// waitFor polls cond until it holds or a second has passed
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within a second")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRemoveFeedForgetsOnlyItsOwnArticles(t *testing.T) {
+	b := newTestBot(
+		FeedSource{Name: "infosec", URL: "https://habr.com/infosec", Weight: 1},
+		FeedSource{Name: "go", URL: "https://habr.com/go", Weight: 1},
+	)
+	b.clock = newFakeClock()
+	shared := Article{Title: "shared", Link: "https://habr.com/ru/articles/1/", GUID: "shared", Date: b.clock.Now()}
+	only := Article{Title: "only", Link: "https://habr.com/ru/articles/2/", GUID: "only", Date: b.clock.Now()}
+	b.storeFeedCache("https://habr.com/infosec", []Article{shared, only})
+	b.storeFeedCache("https://habr.com/go", []Article{shared})
+
+	shared.Feed, only.Feed = "infosec", "infosec"
+	b.history.Add([]Article{shared, only}, b.clock.Now())
+	b.markClaimed(b.seen, []Article{shared, only})
+
+	if err := b.removeFeed("infosec"); err != nil {
+		t.Fatal(err)
+	}
+
+	if entry, ok := b.seen.Get(shared.ID()); !ok || entry.Feed != "go" {
+		t.Errorf("shared article dedup entry = %+v, %v; want kept under go", entry, ok)
+	}
+	if _, ok := b.seen.Get(only.ID()); ok {
+		t.Error("dedup entry of the removed feed's own article kept")
+	}
+	if claimed := b.claimNewArticles(b.seen, []Article{shared}, 0, true); len(claimed) != 0 {
+		t.Error("shared article would be sent again")
+	}
+
+	history := b.history.Since(b.clock.Now().Add(-time.Hour))
+	if len(history) != 1 || history[0].GUID != "shared" || history[0].Feed != "go" {
+		t.Errorf("history after removal = %+v, want only the shared article under go", history)
+	}
+	if _, ok := b.feedCache["https://habr.com/infosec"]; ok {
+		t.Error("cache of the removed feed kept")
+	}
+}
+
+func TestRemovedFeedsStayRemoved(t *testing.T) {
+	feeds := []FeedSource{
+		{Name: "infosec", URL: "https://habr.com/infosec", Weight: 1},
+		{Name: "go", URL: "https://habr.com/go", Weight: 1},
+	}
+	path := filepath.Join(t.TempDir(), "seen.json.removed")
+	b := newTestBot(feeds...)
+	if err := b.loadRemovedFeeds(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.removeFeed("go"); err != nil {
+		t.Fatal(err)
+	}
+
+	// After a restart FEEDS still lists the feed, but it stays removed
+	restarted := newTestBot(feeds...)
+	if err := restarted.loadRemovedFeeds(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := restarted.listFeeds(); len(got) != 1 || got[0].Name != "infosec" {
+		t.Errorf("feeds after restart = %+v, want only infosec", got)
+	}
+}
+
+func TestRemoveFeedKeepsDedupWhenNotPersisted(t *testing.T) {
+	b := newTestBot(
+		FeedSource{Name: "infosec", URL: "https://habr.com/infosec", Weight: 1},
+		FeedSource{Name: "go", URL: "https://habr.com/go", Weight: 1},
+	)
+	// A directory that doesn't exist can't be written to
+	b.removedFeedsPath = filepath.Join(t.TempDir(), "missing", "seen.json.removed")
+	article := Article{Title: "only", Link: "https://habr.com/ru/articles/2/", GUID: "only", Feed: "go"}
+	b.markClaimed(b.seen, []Article{article})
+
+	if err := b.removeFeed("go"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.seen.Get(article.ID()); !ok {
+		t.Error("dedup entry dropped although the removal wasn't persisted")
+	}
+}
+
+func TestRemoveLastFeed(t *testing.T) {
+	b := newTestBot(FeedSource{Name: "infosec", URL: "https://habr.com/infosec", Weight: 1})
+	if err := b.removeFeed("infosec"); !errors.Is(err, errLastFeed) {
+		t.Errorf("removing the last feed = %v, want errLastFeed", err)
+	}
+	if err := b.removeFeed("nosuchfeed"); err == nil {
+		t.Error("removing an unknown feed succeeded")
+	}
+}
+
+func TestFileSeenStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seen.json")
+	store, err := newFileSeenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sentAt := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+	want := map[string]SeenEntry{
+		"a": {SentAt: sentAt, Feed: "infosec", ContentHash: contentHash("A", "text")},
+		"b": {SentAt: sentAt.Add(time.Minute), Feed: "go", ContentHash: contentHash("B", ""), RenotifiedAt: sentAt.Add(time.Hour)},
+	}
+	for key, entry := range want {
+		store.Put(key, entry)
+	}
+	store.MarkIfNew("c", SeenEntry{SentAt: sentAt, Feed: "infosec"}, time.Hour)
+	store.Delete("c")
+
+	reopened, err := newFileSeenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := reopened.Len(); n != len(want) {
+		t.Errorf("reopened store has %d entries, want %d", n, len(want))
+	}
+	for key, entry := range want {
+		got, ok := reopened.Get(key)
+		if !ok || !got.SentAt.Equal(entry.SentAt) || !got.RenotifiedAt.Equal(entry.RenotifiedAt) ||
+			got.Feed != entry.Feed || got.ContentHash != entry.ContentHash {
+			t.Errorf("entry %s = %+v, %v; want %+v", key, got, ok, entry)
+		}
+	}
+}
+
+func TestFileSeenStoreMissingFile(t *testing.T) {
+	store, err := newFileSeenStore(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.Len() != 0 {
+		t.Errorf("new store has %d entries", store.Len())
+	}
+}
+
+func TestRapidEditsRenotifyOnce(t *testing.T) {
+	b := newTestBot()
+	clock := newFakeClock()
+	b.clock = clock
+	b.notifyUpdates = true
+	b.renotifyInterval = 6 * time.Hour
+	b.articleExpiry = 48 * time.Hour
+
+	version := func(n int) []Article {
+		title, text := "Статья", fmt.Sprintf("версия %d", n)
+		return []Article{{Title: title, GUID: "a", Content: text, ContentHash: contentHash(title, text)}}
+	}
+	claim := func(n int) []Article {
+		return b.claimNewArticles(b.seen, version(n), 0, false)
+	}
+
+	if got := claim(1); len(got) != 1 || got[0].Updated {
+		t.Fatalf("first sighting = %+v, want one new article", got)
+	}
+
+	// Edits right after the first send are held back
+	clock.Advance(time.Minute)
+	if got := claim(2); len(got) != 0 {
+		t.Errorf("edit within renotifyInterval of the send re-notified: %+v", got)
+	}
+
+	renotified := 0
+	clock.Advance(b.renotifyInterval)
+	for n := 3; n <= 6; n++ {
+		for _, article := range claim(n) {
+			if !article.Updated {
+				t.Errorf("edit %d claimed as a new article", n)
+			}
+			renotified++
+		}
+		clock.Advance(time.Minute)
+	}
+	if renotified != 1 {
+		t.Errorf("%d re-notifications for a burst of edits, want 1", renotified)
+	}
+
+	// The next edit after a full interval notifies again
+	clock.Advance(b.renotifyInterval)
+	if got := claim(7); len(got) != 1 || !got[0].Updated {
+		t.Errorf("edit after renotifyInterval = %+v, want one update", got)
+	}
+}
+
+func TestUpdatesIgnoredWhenNotifyUpdatesOff(t *testing.T) {
+	b := newTestBot()
+	clock := newFakeClock()
+	b.clock = clock
+
+	b.claimNewArticles(b.seen, []Article{{GUID: "a", ContentHash: contentHash("a", "1")}}, 0, false)
+	clock.Advance(24*time.Hour - time.Minute)
+	if got := b.claimNewArticles(b.seen, []Article{{GUID: "a", ContentHash: contentHash("a", "2")}}, 0, false); len(got) != 0 {
+		t.Errorf("edited article re-sent with NOTIFY_UPDATES off: %+v", got)
+	}
+}
+
+func TestCutAtMarker(t *testing.T) {
+	markers := newTestBot().summaryCutMarkers
+	tests := []struct {
+		name    string
+		summary string
+		want    string
+	}{
+		{"no marker", "<p>Всё описание</p>", "<p>Всё описание</p>"},
+		{"comment marker", "<p>Начало</p><!-- more --><p>Продолжение</p>", "<p>Начало</p>"},
+		{"earliest marker wins", "Раз<!--more-->Два<!-- more -->Три", "Раз"},
+		{"marker in href", `Начало <a href="https://habr.com/ru/articles/1/#habracut">Читать далее</a>`, "Начало "},
+		{"anchor marker", `Начало <a name="habracut"></a>Продолжение`, "Начало "},
+		{"mention in prose", "Про тег habracut на Хабре", "Про тег habracut на Хабре"},
+	}
+	for _, tt := range tests {
+		if got := cutAtMarker(tt.summary, markers); got != tt.want {
+			t.Errorf("%s: cutAtMarker(%q) = %q, want %q", tt.name, tt.summary, got, tt.want)
+		}
+	}
+	if got := cutAtMarker("a<!-- more -->b", nil); got != "a<!-- more -->b" {
+		t.Errorf("cut without markers: %q", got)
+	}
+}
+
+func TestTrimSummaryAtMarker(t *testing.T) {
+	b := newTestBot()
+	summary := `<p>Короткое начало.</p><a href="https://habr.com/ru/articles/1/#habracut">Читать далее</a>`
+	if got := b.trimSummary(summary, 200); strings.Contains(got, "Читать далее") || !strings.Contains(got, "Короткое начало.") {
+		t.Errorf("trimSummary = %q, want the text before the cut", got)
+	}
+}
+
+func TestReadPathsDontStealPushes(t *testing.T) {
+	srv := newFeedServer(t,
+		testItem{Title: "Первая", Link: "https://habr.com/ru/articles/1/", GUID: "habr-1"},
+		testItem{Title: "Вторая", Link: "https://habr.com/ru/articles/2/", GUID: "habr-2"},
+	)
+	b := newTestBot(FeedSource{Name: "infosec", URL: srv.URL, Weight: 1})
+	sender, _ := withSender(b)
+	b.pushChatIDs = []int64{42}
+
+	rec := httptest.NewRecorder()
+	b.handleArticlesAPI(rec, httptest.NewRequest("GET", "/api/articles", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("API status = %d", rec.Code)
+	}
+	if articles, err := b.getHabrInfoSecFeed(true); err != nil || len(articles) != 2 {
+		t.Fatalf("/infosec after the API got %d articles, %v; want 2", len(articles), err)
+	}
+
+	b.pollOnce(false)
+	for _, title := range []string{"Первая", "Вторая"} {
+		if n := sender.countContaining(42, title); n != 1 {
+			t.Errorf("push chat got %q %d times, want once", title, n)
+		}
+	}
+
+	// The next cycle has nothing new for the push chat
+	b.pollOnce(false)
+	if n := len(sender.messages(42)); n != 2 {
+		t.Errorf("push chat got %d messages after two cycles, want 2", n)
+	}
+}
+
+func TestInfoSecDoesntRepeatDeferredPushes(t *testing.T) {
+	srv := newFeedServer(t,
+		testItem{Title: "Первая", Link: "https://habr.com/ru/articles/1/", GUID: "habr-1"},
+		testItem{Title: "Вторая", Link: "https://habr.com/ru/articles/2/", GUID: "habr-2"},
+	)
+	b := newTestBot(FeedSource{Name: "infosec", URL: srv.URL, Weight: 1})
+	sender, clock := withSender(b)
+	b.pushChatIDs = []int64{42}
+	b.chatHourlyCap, b.deferOverflow = 1, true
+
+	// The poller pushes one article and defers the other
+	b.pollOnce(false)
+	clock.Advance(2 * time.Hour)
+	b.chatHourlyCap = 10
+
+	// The deferred article goes out once, not also as a fresh one
+	b.sendInfoSecFeed(42)
+	if n := sender.countContaining(42, "Вторая"); n != 1 {
+		t.Errorf("/infosec sent the deferred article %d times, want once", n)
+	}
+
+	// The deferred article counts as sent for /infosec from now on
+	clock.Advance(2 * time.Hour)
+	b.sendInfoSecFeed(42)
+	if n := sender.countContaining(42, "Вторая"); n != 1 {
+		t.Errorf("second /infosec repeated the deferred article, got it %d times", n)
+	}
+}
+
+func TestArticlesAPIIsReadOnly(t *testing.T) {
+	srv := newFeedServer(t, testItem{Title: "Первая", Link: "https://habr.com/ru/articles/1/", GUID: "habr-1"})
+	b := newTestBot(FeedSource{Name: "infosec", URL: srv.URL, Weight: 1})
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		b.handleArticlesAPI(rec, httptest.NewRequest("GET", "/api/articles", nil))
+		var got []map[string]string
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || len(got) != 1 {
+			t.Fatalf("request %d returned %d articles, %v; want 1", i+1, len(got), err)
+		}
+	}
+	if n := b.seen.Len() + b.pushed.Len(); n != 0 {
+		t.Errorf("API marked %d articles as sent", n)
+	}
+}
+
+func TestSortArticlesBreaksTiesByWeight(t *testing.T) {
+	now := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+	articles := []Article{
+		{GUID: "light-old", Feed: "light", Date: now.Add(-time.Hour)},
+		{GUID: "light-tie", Feed: "light", Date: now},
+		{GUID: "heavy-tie", Feed: "heavy", Date: now},
+		{GUID: "light-new", Feed: "light", Date: now.Add(time.Minute)},
+	}
+	sortArticles(articles, map[string]int{"heavy": 3, "light": 1})
+
+	want := []string{"light-new", "heavy-tie", "light-tie", "light-old"}
+	for i, article := range articles {
+		if article.GUID != want[i] {
+			t.Fatalf("order = %v, want %v", guids(articles), want)
+		}
+	}
+}
+
+func TestSelectWeightedSharesSlots(t *testing.T) {
+	// Alternate the feeds so neither wins just by being newer
+	var candidates []Article
+	heavy, light := testArticles("heavy", 10), testArticles("light", 10)
+	for i := range heavy {
+		candidates = append(candidates, light[i], heavy[i])
+	}
+
+	tests := []struct {
+		name       string
+		candidates []Article
+		weights    map[string]int
+		limit      int
+		want       map[string]int
+	}{
+		{"by weight", candidates, map[string]int{"heavy": 3, "light": 1}, 8, map[string]int{"heavy": 6, "light": 2}},
+		{"equal weights", candidates, map[string]int{"heavy": 1, "light": 1}, 6, map[string]int{"heavy": 3, "light": 3}},
+		{"unfilled share goes to others", append(testArticles("heavy", 10), testArticles("light", 1)...),
+			map[string]int{"heavy": 1, "light": 1}, 6, map[string]int{"heavy": 5, "light": 1}},
+		{"fewer candidates than slots", testArticles("light", 3), map[string]int{"heavy": 1, "light": 1}, 10, map[string]int{"light": 3}},
+	}
+	for _, tt := range tests {
+		selected := selectWeighted(tt.candidates, tt.weights, tt.limit)
+		got := make(map[string]int)
+		for _, article := range selected {
+			got[article.Feed]++
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: per-feed counts = %v, want %v", tt.name, got, tt.want)
+		}
+
+		// The selection keeps the candidates' order
+		pos := make(map[string]int)
+		for i, article := range tt.candidates {
+			pos[article.GUID] = i
+		}
+		for i := 1; i < len(selected); i++ {
+			if pos[selected[i-1].GUID] > pos[selected[i].GUID] {
+				t.Errorf("%s: selection out of order: %v", tt.name, guids(selected))
+				break
+			}
+		}
+	}
+}
+
+// guids lists the articles' GUIDs for failure messages
+func guids(articles []Article) []string {
+	var out []string
+	for _, article := range articles {
+		out = append(out, article.GUID)
+	}
+	return out
+}
+
+// redirectClient returns a client with the feed redirect policy that sends
+// every http connection to plain and every https connection to secure,
+// whatever the host name
+func redirectClient(plain, secure *httptest.Server) *http.Client {
+	transport := secure.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.InsecureSkipVerify = true
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		target := plain.Listener.Addr().String()
+		if strings.HasSuffix(addr, ":443") {
+			target = secure.Listener.Addr().String()
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, target)
+	}
+	return &http.Client{Transport: transport, CheckRedirect: checkFeedRedirect}
+}
+
+func TestFeedRedirects(t *testing.T) {
+	var hops atomic.Int32
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/upgrade":
+			http.Redirect(w, r, "https://habr.com/feed", http.StatusMovedPermanently)
+		case "/downgrade":
+			http.Redirect(w, r, "http://habr.com/feed", http.StatusMovedPermanently)
+		case "/loop":
+			hops.Add(1)
+			http.Redirect(w, r, "/loop", http.StatusMovedPermanently)
+		default:
+			fmt.Fprint(w, rssFeed(testItem{Title: "t", Link: "https://habr.com/ru/articles/1/", GUID: "1"}))
+		}
+	}
+	plain := httptest.NewServer(http.HandlerFunc(handler))
+	t.Cleanup(plain.Close)
+	secure := httptest.NewTLSServer(http.HandlerFunc(handler))
+	t.Cleanup(secure.Close)
+	client := redirectClient(plain, secure)
+
+	var logs strings.Builder
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	// http to https is followed quietly
+	resp, err := client.Get("http://habr.com/upgrade")
+	if err != nil {
+		t.Fatalf("upgrade: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.String() != "https://habr.com/feed" {
+		t.Errorf("upgrade ended at %s with %d, want https://habr.com/feed with 200", resp.Request.URL, resp.StatusCode)
+	}
+	if logs.Len() != 0 {
+		t.Errorf("upgrade logged %q", logs.String())
+	}
+
+	// https to http is followed but logged
+	resp, err = client.Get("https://habr.com/downgrade")
+	if err != nil {
+		t.Fatalf("downgrade: %v", err)
+	}
+	resp.Body.Close()
+	if resp.Request.URL.String() != "http://habr.com/feed" {
+		t.Errorf("downgrade ended at %s, want http://habr.com/feed", resp.Request.URL)
+	}
+	if !strings.Contains(logs.String(), "suspicious redirect downgrading") {
+		t.Errorf("downgrade not logged, got %q", logs.String())
+	}
+
+	// Endless redirects stop at the cap
+	_, err = client.Get("http://habr.com/loop")
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("stopped after %d redirects", maxFeedRedirects)) {
+		t.Errorf("loop error = %v, want the redirect cap", err)
+	}
+	if n := hops.Load(); n != maxFeedRedirects {
+		t.Errorf("loop made %d requests, want %d", n, maxFeedRedirects)
+	}
+}
+
+func TestFeedDialerRefusesPrivateAddresses(t *testing.T) {
+	srv := newFeedServer(t, testItem{Title: "t", Link: "https://habr.com/ru/articles/1/", GUID: "1"})
+	b := newTestBot(FeedSource{Name: "infosec", URL: srv.URL, Weight: 1})
+	b.feedDialer.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("93.184.216.34")}, {IP: net.ParseIP("10.0.0.7")}}, nil
+	}
+
+	// A configured feed may live on a private address
+	resp, err := b.httpClient.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("configured feed: %v", err)
+	}
+	resp.Body.Close()
+
+	// A name resolving into the internal network is refused
+	_, err = b.httpClient.Get("http://innocent.example/feed")
+	if err == nil || !strings.Contains(err.Error(), "10.0.0.7 is a private address") {
+		t.Errorf("error = %v, want the private address refused", err)
+	}
+}
+
+func TestSummaryLenCommandClamps(t *testing.T) {
+	b := newTestBot()
+	sender, _ := withSender(b)
+
+	tests := []struct {
+		arg  string
+		want int
+	}{
+		{"300", 300},
+		{"10", minSummaryLength},
+		{"5000", maxSummaryLength},
+		{"abc", maxSummaryLength}, // rejected, keeps the previous value
+		{"default", 0},
+	}
+	for _, tt := range tests {
+		b.handleSummaryLenCommand(42, []string{tt.arg})
+		if got := b.settings.Get(42).SummaryLength; got != tt.want {
+			t.Errorf("/summarylen %s: stored %d, want %d", tt.arg, got, tt.want)
+		}
+	}
+	if n := len(sender.messages(42)); n != len(tests) {
+		t.Errorf("%d replies, want %d", n, len(tests))
+	}
+}
+
+func TestSendArticleUsesChatSummaryLength(t *testing.T) {
+	b := newTestBot()
+	sender, _ := withSender(b)
+	content := strings.Repeat("x", 150) + strings.Repeat("q", 500)
+	article := Article{
+		Title:   "Заголовок",
+		Summary: b.trimSummary(content, b.summaryLength),
+		Content: content,
+		Link:    "https://habr.com/ru/articles/1/",
+	}
+	b.settings.Update(1, func(cs *ChatSettings) { cs.SummaryLength = 150 })
+
+	b.sendArticle(1, article)
+	b.sendArticle(2, article)
+
+	short, def := sender.messages(1), sender.messages(2)
+	if len(short) != 1 || len(def) != 1 {
+		t.Fatalf("sent %d and %d messages, want one each", len(short), len(def))
+	}
+	if !strings.Contains(short[0].Text, strings.Repeat("x", 150)+"...") || strings.Contains(short[0].Text, "q") {
+		t.Errorf("chat with length 150 got %q", short[0].Text)
+	}
+	if !strings.Contains(def[0].Text, article.Summary) {
+		t.Errorf("chat with the default length got %q, want the default summary", def[0].Text)
+	}
+}
+
+func TestAlertsFilterBySeverity(t *testing.T) {
+	b := newTestBot()
+	sender, _ := withSender(b)
+	b.pushChatIDs = []int64{1}
+	b.settings.Update(2, func(cs *ChatSettings) { cs.AlertSeverity = "high" })
+	b.settings.Update(3, func(cs *ChatSettings) { cs.AlertSeverity = "critical" })
+
+	var articles []Article
+	for i, tt := range []struct {
+		title string
+		want  Severity
+	}{
+		{"Обзор новых сертификаций", SeverityLow},
+		{"Фишинговая кампания против банков", SeverityMedium},
+		{"Разбор CVE-2024-1234 в роутерах", SeverityHigh},
+		{"Zero-day в браузере активно эксплуатируется", SeverityCritical},
+	} {
+		article := Article{
+			Title:    tt.title,
+			GUID:     fmt.Sprintf("sev-%d", i),
+			Link:     fmt.Sprintf("https://habr.com/ru/articles/%d/", i),
+			Severity: classifySeverity(tt.title, ""),
+		}
+		if article.Severity != tt.want {
+			t.Errorf("classifySeverity(%q) = %s, want %s", tt.title, article.Severity, tt.want)
+		}
+		articles = append(articles, article)
+	}
+
+	b.deliverToPushChats(articles)
+
+	for chatID, want := range map[int64]int{1: 4, 2: 2, 3: 1} {
+		if got := len(sender.messages(chatID)); got != want {
+			t.Errorf("chat %d got %d articles, want %d", chatID, got, want)
+		}
+	}
+	if sender.countContaining(3, "Zero-day") != 1 {
+		t.Errorf("chat with the critical threshold missed the zero-day: %v", sender.messages(3))
+	}
+	if sender.countContaining(2, "Фишинговая") != 0 {
+		t.Errorf("chat with the high threshold got a medium article: %v", sender.messages(2))
+	}
+}
+
+func TestFetchFeedFallsBackToMirror(t *testing.T) {
+	var primaryDown atomic.Bool
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if primaryDown.Load() {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+		fmt.Fprint(w, rssFeed(
+			testItem{Title: "A", Link: "https://habr.com/ru/articles/1/", GUID: "habr-1"},
+			testItem{Title: "B", Link: "https://habr.com/ru/articles/2/", GUID: "habr-2"},
+		))
+	}))
+	t.Cleanup(primary.Close)
+	// The mirror rewrites links but keeps the GUIDs
+	mirror := newFeedServer(t,
+		testItem{Title: "A", Link: "https://mirror.example/1/", GUID: "habr-1"},
+		testItem{Title: "B", Link: "https://mirror.example/2/", GUID: "habr-2"},
+		testItem{Title: "C", Link: "https://mirror.example/3/", GUID: "habr-3"},
+	)
+	b := newTestBot(FeedSource{Name: "infosec", URL: primary.URL, FallbackURL: mirror.URL, Weight: 1})
+
+	articles, err := b.getHabrInfoSecFeed(true)
+	if err != nil || len(articles) != 2 {
+		t.Fatalf("primary read = %v, %v; want 2 articles", guids(articles), err)
+	}
+
+	primaryDown.Store(true)
+	articles, err = b.getHabrInfoSecFeed(true)
+	if err != nil {
+		t.Fatalf("fallback read: %v", err)
+	}
+	if got := guids(articles); len(got) != 1 || got[0] != "habr-3" {
+		t.Errorf("fallback read = %v, want only [habr-3]", got)
+	}
+	if articles[0].Feed != "infosec" {
+		t.Errorf("fallback article attributed to %q, want infosec", articles[0].Feed)
+	}
+}
+
+func TestWeeklySchedule(t *testing.T) {
+	now := newFakeClock().Now() // Monday 12:00
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 3, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name   string
+		weekly WeeklyRoundup
+		want   time.Time
+	}{
+		{"earlier today", WeeklyRoundup{Day: time.Monday, Hour: 9}, at(4, 9, 0)},
+		{"right now", WeeklyRoundup{Day: time.Monday, Hour: 12}, at(4, 12, 0)},
+		{"later today", WeeklyRoundup{Day: time.Monday, Hour: 13, Minute: 30}, time.Date(2024, 2, 26, 13, 30, 0, 0, time.UTC)},
+		{"yesterday", WeeklyRoundup{Day: time.Sunday, Hour: 23, Minute: 59}, at(3, 23, 59)},
+		{"later this week", WeeklyRoundup{Day: time.Friday, Hour: 9}, time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		if got := tt.weekly.lastOccurrence(now); !got.Equal(tt.want) {
+			t.Errorf("%s: lastOccurrence = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	// Scheduled just now for Monday 09:00: the next roundup is a week out
+	weekly := WeeklyRoundup{Day: time.Monday, Hour: 9, LastSent: now}
+	for _, tt := range []struct {
+		now  time.Time
+		want bool
+	}{
+		{now, false},
+		{at(11, 8, 59), false},
+		{at(11, 9, 0), true},
+		{at(13, 0, 0), true},
+	} {
+		if got := weekly.due(tt.now); got != tt.want {
+			t.Errorf("due(%s) = %v, want %v", tt.now, got, tt.want)
+		}
+	}
+}
+
+func TestWeeklyTopArticles(t *testing.T) {
+	now := newFakeClock().Now()
+	history := []Article{
+		{GUID: "old", Feed: "infosec", Date: now.AddDate(0, 0, -8)},
+		{GUID: "future", Feed: "infosec", Date: now.Add(time.Hour)},
+		{GUID: "monday", Feed: "infosec", Date: now.AddDate(0, 0, -7).Add(time.Minute)},
+		{GUID: "light", Feed: "go", Date: now.AddDate(0, 0, -1)},
+		{GUID: "heavy", Feed: "infosec", Date: now.AddDate(0, 0, -1)},
+		{GUID: "wednesday", Feed: "go", Date: now.AddDate(0, 0, -5)},
+	}
+	weights := map[string]int{"infosec": 3, "go": 1}
+
+	got := guids(weeklyTopArticles(history, weights, now, 3))
+	if want := []string{"heavy", "light", "wednesday"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("top 3 = %v, want %v", got, want)
+	}
+	got = guids(weeklyTopArticles(history, weights, now, 10))
+	if want := []string{"heavy", "light", "wednesday", "monday"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("top 10 = %v, want %v", got, want)
+	}
+}
+
+func TestWeeklyCommandWarnsWithoutPoller(t *testing.T) {
+	b := newTestBot()
+	sender, _ := withSender(b)
+
+	b.handleWeeklyCommand(42, []string{"5", "пн", "09:00"})
+	if sender.countContaining(42, "опрос лент сейчас отключён") != 1 {
+		t.Errorf("no poller warning with POLL_INTERVAL=0: %v", sender.messages(42))
+	}
+
+	b.pollInterval = 10 * time.Minute
+	b.handleWeeklyCommand(43, []string{"5", "пн", "09:00"})
+	if sender.countContaining(43, "опрос лент сейчас отключён") != 0 {
+		t.Errorf("poller warning with the poller on: %v", sender.messages(43))
+	}
+}
+
+func TestMarkIfNewIsAtomic(t *testing.T) {
+	fileStore, err := newFileSeenStore(filepath.Join(t.TempDir(), "seen.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]SeenStore{"memory": newMemorySeenStore(), "file": fileStore}
+
+	for name, store := range stores {
+		const callers = 50
+		var wins atomic.Int32
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		entry := SeenEntry{SentAt: newFakeClock().Now(), Feed: "infosec"}
+		for i := 0; i < callers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				if store.MarkIfNew("habr-1", entry, time.Hour) {
+					wins.Add(1)
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		if n := wins.Load(); n != 1 {
+			t.Errorf("%s store: %d of %d parallel MarkIfNew calls won, want exactly 1", name, n, callers)
+		}
+	}
+}
+
+func TestFutureDatedItems(t *testing.T) {
+	clock := newFakeClock()
+	now := clock.Now()
+	srv := newFeedServer(t,
+		testItem{Title: "future", Link: "https://habr.com/ru/articles/1/", GUID: "future", Date: now.Add(48 * time.Hour)},
+		testItem{Title: "slightly ahead", Link: "https://habr.com/ru/articles/2/", GUID: "ahead", Date: now.Add(5 * time.Minute)},
+		testItem{Title: "past", Link: "https://habr.com/ru/articles/3/", GUID: "past", Date: now.Add(-time.Hour)},
+	)
+
+	for _, skip := range []bool{false, true} {
+		b := newTestBot(FeedSource{Name: "infosec", URL: srv.URL, Weight: 1})
+		b.clock = clock
+		b.skipFutureDates = skip
+
+		articles, err := b.fetchFeedArticles(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dates := make(map[string]time.Time)
+		for _, article := range articles {
+			dates[article.GUID] = article.Date
+		}
+
+		future, ok := dates["future"]
+		switch {
+		case skip && ok:
+			t.Errorf("skip: future item kept, dated %s", future)
+		case !skip && !ok:
+			t.Errorf("clamp: future item dropped")
+		case !skip && !future.Equal(now):
+			t.Errorf("clamp: future item dated %s, want now (%s)", future, now)
+		}
+		// Within the tolerance and in the past the date is left alone
+		if got := dates["ahead"]; !got.Equal(now.Add(5 * time.Minute)) {
+			t.Errorf("skip %v: item within tolerance dated %s", skip, got)
+		}
+		if got := dates["past"]; !got.Equal(now.Add(-time.Hour)) {
+			t.Errorf("skip %v: past item dated %s", skip, got)
+		}
+	}
+}
+
+func TestPingMeasuresFromReceipt(t *testing.T) {
+	b := newTestBot()
+	sender, clock := withSender(b)
+
+	receivedAt := clock.Now()
+	clock.Advance(15 * time.Millisecond)
+	b.handlePingCommand(1, receivedAt)
+	if sender.countContaining(1, "Время ответа: 15.0 мс") != 1 {
+		t.Errorf("ping reply = %v, want 15.0 мс", sender.messages(1))
+	}
+}
+
+func TestSendFollowsChatMigration(t *testing.T) {
+	const oldID, newID = -100, -1001234567890
+	b := newTestBot()
+	sender, clock := withSender(b)
+	sender.fail = func(msg tgbotapi.MessageConfig) error {
+		if msg.ChatID == oldID {
+			return tgbotapi.Error{
+				Message:            "Bad Request: group chat was upgraded to a supergroup chat",
+				ResponseParameters: tgbotapi.ResponseParameters{MigrateToChatID: newID},
+			}
+		}
+		return nil
+	}
+	b.pushChatIDs = []int64{7, oldID}
+	b.settings.Update(oldID, func(cs *ChatSettings) { cs.AlertSeverity = "high" })
+
+	// Both IDs have sends within the hour, interleaved in time
+	now := clock.Now()
+	b.chatSends[oldID] = []time.Time{now.Add(-70 * time.Minute), now.Add(-10 * time.Minute)}
+	b.chatSends[newID] = []time.Time{now.Add(-50 * time.Minute), now.Add(-30 * time.Minute)}
+
+	b.sendArticle(oldID, testArticles("infosec", 1)[0])
+
+	if n := len(sender.messages(newID)); n != 1 {
+		t.Errorf("%d messages reached the new chat ID, want the retried one", n)
+	}
+	if got := b.settings.Get(newID).AlertSeverity; got != "high" {
+		t.Errorf("new chat alert = %q, want high", got)
+	}
+	if got := b.settings.Get(oldID).AlertSeverity; got != "" {
+		t.Errorf("old chat still has alert %q", got)
+	}
+	if got := b.pushChats(); len(got) != 2 || got[0] != 7 || got[1] != newID {
+		t.Errorf("push chats = %v, want [7 %d]", got, int64(newID))
+	}
+
+	// The merged send times stay ordered, so pruning drops exactly the old one
+	b.chatSendsMux.Lock()
+	sends := pruneSends(b.chatSends[newID], now.Add(-time.Hour))
+	_, oldLeft := b.chatSends[oldID]
+	b.chatSendsMux.Unlock()
+	if len(sends) != 3 || oldLeft {
+		t.Errorf("sends after migration and pruning = %v (old ID kept: %v), want 3 on the new ID", sends, oldLeft)
+	}
+}
+
+func TestHistoryArchive(t *testing.T) {
+	b := newTestBot()
+	clock := newFakeClock()
+	b.clock = clock
+	old := Article{Title: "Старая", Link: "https://habr.com/ru/articles/1/", GUID: "old", Feed: "infosec", Summary: "кратко", Content: "полный текст", Date: clock.Now()}
+	b.history.Add([]Article{old}, clock.Now())
+	clock.Advance(48 * time.Hour)
+	fresh := Article{Title: "Новая", Link: "https://habr.com/ru/articles/2/", GUID: "fresh", Feed: "infosec", Summary: "свежее", Content: "свежий текст", Date: clock.Now()}
+	b.history.Add([]Article{fresh}, clock.Now())
+
+	if n := b.history.Archive(clock.Now().Add(-24 * time.Hour)); n != 1 {
+		t.Fatalf("archived %d entries, want 1", n)
+	}
+	if n := b.history.Archive(clock.Now().Add(-24 * time.Hour)); n != 0 {
+		t.Errorf("archiving again touched %d entries", n)
+	}
+	for _, entry := range b.history.Entries() {
+		switch entry.GUID {
+		case "old":
+			if !entry.Archived || entry.Summary != "" || entry.Content != "" || entry.Title != old.Title || entry.Link != old.Link {
+				t.Errorf("archived entry = %+v, want title and link only", entry)
+			}
+		case "fresh":
+			if entry.Archived || entry.Summary != fresh.Summary || entry.Content != fresh.Content {
+				t.Errorf("recent entry changed: %+v", entry)
+			}
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	b.handleHistoryAPI(rec, httptest.NewRequest("GET", "/api/history", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %q", rec.Code, rec.Body)
+	}
+	var got []map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d entries, want 2", len(got))
+	}
+	// Newest first: the fresh entry, then the archived one without a summary
+	if got[0]["summary"] != fresh.Summary || got[0]["archived"] != false {
+		t.Errorf("recent entry = %v", got[0])
+	}
+	if _, ok := got[1]["summary"]; ok || got[1]["archived"] != true || got[1]["title"] != old.Title {
+		t.Errorf("archived entry = %v, want title without summary, archived", got[1])
+	}
+}
@@ -1,10 +1,11 @@
 #!/bin/bash
 
 # Check if TELEGRAM_BOT_TOKEN is set
-if [ -z "$TELEGRAM_BOT_TOKEN" ]; then
+if [ -z "$TELEGRAM_BOT_TOKEN" ] && [ -z "$TELEGRAM_BOT_TOKEN_FILE" ]; then
     echo "Error: TELEGRAM_BOT_TOKEN environment variable is not set"
     echo "Please set it before running the bot:"
     echo "export TELEGRAM_BOT_TOKEN=your_bot_token_here"
+    echo "or point TELEGRAM_BOT_TOKEN_FILE at a file containing the token"
     echo "For testing purposes, you can set a dummy value, but the bot won't work without a real token"
     echo "Starting with a dummy token for testing the web interface only..."
     export TELEGRAM_BOT_TOKEN="dummy_token_for_testing"